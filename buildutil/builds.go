@@ -35,6 +35,10 @@ type BuildCache interface {
 	// location. If the version cannot be retrieved an error will
 	// be returned.
 	InstallVersion(versionutil.Version, string) error
+
+	// Digest returns the digest of the cached binary for the
+	// version, or an empty digest if the version is not cached.
+	Digest(versionutil.Version) (digest.Digest, error)
 }
 
 type fsBuildCache struct {
@@ -130,6 +134,14 @@ func binaryDigest(source string) (digest.Digest, error) {
 	return digest.FromReader(f)
 }
 
+func (bc *fsBuildCache) Digest(v versionutil.Version) (digest.Digest, error) {
+	cached := bc.getCached(v)
+	if cached == "" {
+		return "", nil
+	}
+	return binaryDigest(cached)
+}
+
 func (bc *fsBuildCache) PutVersion(v versionutil.Version, source string) error {
 	cached := bc.getCached(v)
 	if cached != "" {
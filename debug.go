@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/golem/clientutil"
+	"github.com/docker/golem/runner"
+)
+
+// debugMain opens a shell inside a running instance container,
+// given either the instance name or the container id
+func debugMain(args []string) {
+	co := clientutil.NewClientOptions()
+	flag.CommandLine.Parse(args)
+
+	if flag.NArg() != 1 {
+		logrus.Fatalf("Expected an instance to debug, got %d", flag.NArg())
+	}
+	instance := flag.Arg(0)
+
+	client, err := runner.NewDockerClient(co)
+	if err != nil {
+		logrus.Fatalf("Failed to create client: %v", err)
+	}
+
+	container := instance
+	if !strings.HasPrefix(instance, "golem-") {
+		if _, err := client.InspectContainer("golem-" + instance); err == nil {
+			container = "golem-" + instance
+		}
+	}
+	if err := runner.DebugShell(client, container); err != nil {
+		logrus.Fatalf("Error opening debug shell: %v", err)
+	}
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/golem/buildutil"
 	"github.com/docker/golem/clientutil"
 	"github.com/docker/golem/runner"
+	"github.com/docker/golem/ui"
 	"github.com/docker/golem/versionutil"
 )
 
@@ -20,10 +24,39 @@ func main() {
 		runnerMain()
 		return
 	}
+	var watchMode bool
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "history":
+			historyMain(os.Args[2:])
+			return
+		case "show":
+			showMain(os.Args[2:])
+			return
+		case "flaky":
+			flakyMain(os.Args[2:])
+			return
+		case "compare":
+			compareMain(os.Args[2:])
+			return
+		case "debug":
+			debugMain(os.Args[2:])
+			return
+		case "watch":
+			watchMode = true
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "run":
+			// Running tests is the default command
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
 	var (
 		dockerBinary string
 		cacheDir     string
 		buildCache   string
+		uiAddr       string
+		rerunFailed  string
+		interval     time.Duration
 	)
 	co := clientutil.NewClientOptions()
 	cm := runner.NewConfigurationManager()
@@ -32,6 +65,9 @@ func main() {
 	flag.StringVar(&dockerBinary, "db", "", "Docker binary to test")
 	flag.StringVar(&cacheDir, "cache", "", "Cache directory")
 	flag.StringVar(&buildCache, "build-cache", "", "Build cache location, if outside of default cache directory")
+	flag.StringVar(&uiAddr, "ui", "", "Address to serve the web dashboard on, such as :8080 for localhost")
+	flag.StringVar(&rerunFailed, "rerun-failed", "", "Run only the failed tests of a previous run, by run id or \"latest\"")
+	flag.DurationVar(&interval, "watch-interval", time.Second, "Interval to poll for changes in watch mode")
 	// TODO: Add swarm flag and host option
 
 	flag.Parse()
@@ -40,6 +76,9 @@ func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 
 	if cacheDir == "" {
+		if rerunFailed != "" {
+			logrus.Fatalf("Cache directory required to rerun failed tests")
+		}
 		td, err := ioutil.TempDir("", "build-cache-")
 		if err != nil {
 			logrus.Fatalf("Error creating tempdir: %v", err)
@@ -60,16 +99,9 @@ func main() {
 	}
 
 	if dockerBinary != "" {
-		v, err := versionutil.BinaryVersion(dockerBinary)
-		if err != nil {
-			logrus.Fatalf("Error getting binary version of %s: %v", dockerBinary, err)
-		}
-		logrus.Debugf("Using local binary with version %s", v.String())
-		if err := c.BuildCache.PutVersion(v, dockerBinary); err != nil {
-			logrus.Fatalf("Error putting %s in cache as %s: %v", dockerBinary, v, err)
+		if err := putBinary(c, dockerBinary); err != nil {
+			logrus.Fatalf("Error using docker binary %s: %v", dockerBinary, err)
 		}
-
-		flag.Set("docker-version", v.String())
 	}
 
 	client, err := runner.NewDockerClient(co)
@@ -91,109 +123,289 @@ func main() {
 	// TODO: Check cache here to ensure that load will not have issues
 	logrus.Debugf("Using docker daemon for image export, version %s", serverVersion)
 
-	r, err := cm.CreateRunner(serverVersion, c)
+	runsDir := filepath.Join(cacheDir, "runs")
+	output := runner.OutputConfiguration{
+		RunsDir: runsDir,
+		Monitor: runner.NewMonitor(),
+		History: runner.NewHistory(runsDir),
+	}
+	if uiAddr != "" {
+		addr, err := ui.NewServer(output.Monitor).ListenAndServe(uiAddr)
+		if err != nil {
+			logrus.Fatalf("Error starting dashboard: %v", err)
+		}
+		logrus.Infof("Serving dashboard on http://%s", addr)
+	}
+
+	if watchMode {
+		if rerunFailed != "" {
+			logrus.Fatalf("Cannot rerun failed tests in watch mode")
+		}
+		watch(client, cm, serverVersion, c, output, dockerBinary, interval)
+		return
+	}
+
+	// Known flaky tests are computed before this run is recorded
+	previousRuns, err := output.History.List()
+	if err != nil {
+		logrus.Errorf("Error reading run history: %v", err)
+	}
+	flaky := runner.Flakiness(previousRuns)
+
+	var r runner.TestRunner
+	if rerunFailed != "" {
+		r, err = cm.CreateRerunner(output.History, rerunFailed, serverVersion, c, output)
+	} else {
+		r, err = cm.CreateRunner(serverVersion, c, output)
+	}
 	if err != nil {
 		logrus.Fatalf("Error creating runner: %v", err)
 	}
 
-	if err := r.Build(client); err != nil {
+	manifest, err := r.Build(client)
+	if err != nil {
 		logrus.Fatalf("Error building test images: %v", err)
 	}
 
-	if err := r.Run(client); err != nil {
+	if err := r.Run(client, manifest); err != nil {
 		logrus.Fatalf("Error running tests: %v", err)
 	}
+
+	if err := runner.WriteSummary(os.Stdout, runner.MergeShards(output.Monitor.Instances()), flaky); err != nil {
+		logrus.Errorf("Error writing summary: %v", err)
+	}
+
+	if uiAddr != "" {
+		logrus.Infof("Run finished, dashboard available until interrupted")
+		sigC := make(chan os.Signal, 1)
+		signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+		<-sigC
+	}
 }
 
 func runnerMain() {
 	var (
-		command string
-		dind    bool
-		clean   bool
+		command       string
+		dind          bool
+		clean         bool
+		keepOnFailure bool
+		debug         bool
+		shell         bool
+		secrets       bool
+		writeSecrets  bool
 	)
 
 	// TODO: Parse runner options
 	flag.StringVar(&command, "command", "bats", "Command to run")
 	flag.BoolVar(&dind, "docker", false, "Whether to run docker")
 	flag.BoolVar(&clean, "clean", false, "Whether to ensure /var/lib/docker is empty")
+	flag.BoolVar(&keepOnFailure, "keep-on-failure", false, "Whether to hold the instance before tear down when failed")
+	flag.BoolVar(&debug, "debug", false, "Whether to hold the instance before running tests")
+	flag.BoolVar(&shell, "shell", false, "Run a debug shell with the test environment")
+	flag.BoolVar(&secrets, "secrets", false, "Whether to wait for the secrets sent by golem")
+	flag.BoolVar(&writeSecrets, "write-secrets", false, "Write the secrets read from stdin")
 
 	flag.Parse()
 
+	if shell {
+		debugShellMain()
+		return
+	}
+
+	if writeSecrets {
+		if err := runner.WriteSecrets(runner.SecretsDir, os.Stdin); err != nil {
+			logrus.Fatalf("Error writing secrets: %v", err)
+		}
+		return
+	}
+
 	// TODO: Allow quiet and verbose mode
 	logrus.SetLevel(logrus.DebugLevel)
 
 	logrus.Debugf("Runner!")
 
-	// Check if has compose file
-	composeFile := "/runner/docker-compose.yml"
-	var composeCapturer runner.LogCapturer
-	if _, err := os.Stat(composeFile); err == nil {
-		composeCapturer = newFileCapturer("compose")
-		defer composeCapturer.Close()
-	} else {
-		logrus.Debugf("No compose file found at %s", composeFile)
+	events, eventsCloser, err := runner.NewFileEventReporter("/var/log/docker")
+	if err != nil {
+		logrus.Fatalf("Error creating event reporter: %v", err)
 	}
+	defer eventsCloser.Close()
 
-	scriptCapturer := newFileCapturer("scripts")
+	scriptCapturer := newFileCapturer(events, "scripts")
 	defer scriptCapturer.Close()
-	loadCapturer := newFileCapturer("load")
+	loadCapturer := newFileCapturer(events, "load")
 	defer loadCapturer.Close()
-	daemonCapturer := newFileCapturer("daemon")
+	daemonCapturer := newFileCapturer(events, "daemon")
 	defer daemonCapturer.Close()
 	testCapturer := runner.NewConsoleLogCapturer()
 	defer testCapturer.Close()
 
-	instanceF, err := os.Open("/instance.json")
+	// Check if has registry mirror images
+	var registryMirror bool
+	if _, err := os.Stat("/images/mirror.json"); err == nil {
+		registryMirror = true
+	}
+
+	instanceConfig, err := runner.ReadRunConfiguration()
 	if err != nil {
-		logrus.Fatalf("Error opening instance file: %v", err)
+		logrus.Fatalf("Error reading instance configuration: %v", err)
+	}
+
+	// Check if has compose files
+	var composeConfig runner.ComposeConfiguration
+	if instanceConfig.Compose != nil {
+		composeConfig = *instanceConfig.Compose
+	}
+	composeFiles := composeConfig.ComposeFiles("/runner")
+	var composeCapturer runner.LogCapturer
+	for _, composeFile := range composeFiles {
+		if _, err := os.Stat(composeFile); err != nil {
+			if instanceConfig.Compose != nil {
+				logrus.Fatalf("Error statting compose file: %v", err)
+			}
+			logrus.Debugf("No compose file found at %s", composeFile)
+			composeFiles = nil
+			break
+		}
+	}
+	if len(composeFiles) > 0 {
+		composeCapturer = newFileCapturer(events, "compose")
+		defer composeCapturer.Close()
 	}
 
-	var instanceConfig runner.RunConfiguration
-	if err := json.NewDecoder(instanceF).Decode(&instanceConfig); err != nil {
-		logrus.Fatalf("Error decoding instance configuration: %v", err)
+	if secrets {
+		if err := runner.WaitSecrets(runner.SecretsDir, time.Minute); err != nil {
+			logrus.Fatalf("Error waiting for secrets: %v", err)
+		}
+	}
+	if err := runner.LoadSecrets(runner.SecretsDir); err != nil {
+		logrus.Fatalf("Error loading secrets: %v", err)
+	}
+	runner.RedactSecretEnv(instanceConfig.SecretEnv)
+
+	var upgradeCapturer runner.LogCapturer
+	if instanceConfig.Upgrade != nil {
+		upgradeCapturer = newFileCapturer(events, "daemon-upgrade")
+		defer upgradeCapturer.Close()
+	}
+
+	namedDaemonCapturers := map[string]runner.LogCapturer{}
+	for _, daemon := range instanceConfig.Daemons {
+		lc := newFileCapturer(events, "daemon-"+daemon.Name)
+		defer lc.Close()
+		namedDaemonCapturers[daemon.Name] = lc
 	}
 
 	suiteConfig := runner.SuiteRunnerConfiguration{
 		DockerLoadLogCapturer: loadCapturer,
 		DockerLogCapturer:     daemonCapturer,
 
+		UpgradeLogCapturer:      upgradeCapturer,
+		NamedDaemonLogCapturers: namedDaemonCapturers,
+
 		RunConfiguration: instanceConfig,
 		SetupLogCapturer: scriptCapturer,
 		TestCapturer:     testCapturer,
 
 		CleanDockerGraph: clean,
 		DockerInDocker:   dind,
+		RegistryMirror:   registryMirror,
 	}
 
 	if composeCapturer != nil {
 		suiteConfig.ComposeCapturer = composeCapturer
-		suiteConfig.ComposeFile = composeFile
+		suiteConfig.ComposeFiles = composeFiles
+		suiteConfig.ComposeLogDir = "/var/log/docker/compose"
+	}
 
+	if len(instanceConfig.PostTest) > 0 {
+		postTestCapturer := newFileCapturer(events, "posttest")
+		defer postTestCapturer.Close()
+		suiteConfig.PostTestLogCapturer = postTestCapturer
+	}
+	if len(instanceConfig.OnFailure) > 0 {
+		onFailureCapturer := newFileCapturer(events, "onfailure")
+		defer onFailureCapturer.Close()
+		suiteConfig.OnFailureLogCapturer = onFailureCapturer
 	}
 
+	suiteConfig.Events = events
+	suiteConfig.LogDir = "/var/log/docker"
+
+	shardFiles, sharded, err := runner.ShardFiles("/runner", instanceConfig.Shards)
+	if err != nil {
+		logrus.Fatalf("Error getting shard test files: %v", err)
+	}
+	suiteConfig.Sharded = sharded
+	suiteConfig.ShardFiles = shardFiles
+
 	r := runner.NewSuiteRunner(suiteConfig)
 
-	if err := r.Setup(); err != nil {
-		logrus.Fatalf("Setup error: %v", err)
+	var runErr error
+	setupErr := r.Setup()
+	if setupErr != nil {
+		logrus.Errorf("Setup error: %v", setupErr)
+	} else {
+		if debug {
+			logrus.Infof("Holding instance for debug shell before running tests")
+			if s := r.Hold(runner.PhaseDebug, syscall.SIGUSR1, syscall.SIGTERM); s == syscall.SIGTERM {
+				runErr = errors.New("stopped before running tests")
+			}
+		}
+		if runErr == nil {
+			runErr = r.RunTests()
+		}
 	}
 
-	runErr := r.RunTests()
+	postErr := r.RunPostTest(setupErr, runErr)
+
+	if keepOnFailure && (setupErr != nil || runErr != nil) {
+		logrus.Infof("Holding failed instance until stopped")
+		r.Hold(runner.PhaseKept, syscall.SIGTERM, syscall.SIGINT)
+	}
 
 	if err := r.TearDown(); err != nil {
 		logrus.Errorf("TearDown error: %v", err)
 	}
 
+	// Close the event stream before exiting
+	eventsCloser.Close()
+
+	if setupErr != nil {
+		logrus.Fatalf("Setup error: %v", setupErr)
+	}
 	if runErr != nil {
 		logrus.Fatalf("Test errored: %v", runErr)
 	}
+	if postErr != nil {
+		logrus.Fatalf("Post test errored: %v", postErr)
+	}
+}
+
+// debugShellMain replaces the runner with a shell using
+// the environment of the tests in the instance
+func debugShellMain() {
+	instanceConfig, err := runner.ReadRunConfiguration()
+	if err != nil {
+		logrus.Fatalf("Error reading instance configuration: %v", err)
+	}
+
+	if err := runner.LoadSecrets(runner.SecretsDir); err != nil {
+		logrus.Fatalf("Error loading secrets: %v", err)
+	}
+
+	if err := runner.ExecShell(runner.DebugEnv(instanceConfig)); err != nil {
+		logrus.Fatalf("Error running shell: %v", err)
+	}
 }
 
-func newFileCapturer(name string) runner.LogCapturer {
+func newFileCapturer(events runner.EventReporter, name string) runner.LogCapturer {
 	basename := filepath.Join("/var/log/docker", name)
 	lc, err := runner.NewFileLogCapturer(basename)
 	if err != nil {
 		logrus.Fatalf("Error creating file capturer for %s: %v", basename, err)
 	}
+	events.Report(runner.Event{Type: runner.EventLogFile, LogFile: name + "-stdout"})
+	events.Report(runner.Event{Type: runner.EventLogFile, LogFile: name + "-stderr"})
 
 	return lc
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/golem/runner"
+)
+
+// openHistory parses the flags of a history command and
+// opens the run history in the cache directory.
+func openHistory(fs *flag.FlagSet, args []string) *runner.History {
+	var cacheDir string
+	fs.StringVar(&cacheDir, "cache", "", "Cache directory")
+	fs.Parse(args)
+
+	if cacheDir == "" {
+		logrus.Fatalf("Cache directory required to read run history")
+	}
+	return runner.NewHistory(filepath.Join(cacheDir, "runs"))
+}
+
+// historyMain lists the recorded runs
+func historyMain(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	history := openHistory(fs, args)
+
+	records, err := history.List()
+	if err != nil {
+		logrus.Fatalf("Error listing runs: %v", err)
+	}
+	if err := runner.WriteHistory(os.Stdout, records); err != nil {
+		logrus.Fatalf("Error writing history: %v", err)
+	}
+}
+
+// showMain prints the details of a recorded run
+func showMain(args []string) {
+	var asJSON bool
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	fs.BoolVar(&asJSON, "json", false, "Print the run record as JSON")
+	history := openHistory(fs, args)
+
+	id := runner.LatestRun
+	if fs.NArg() > 0 {
+		id = fs.Arg(0)
+	}
+	record, err := history.Get(id)
+	if err != nil {
+		logrus.Fatalf("Error getting run: %v", err)
+	}
+
+	if asJSON {
+		enc, err := json.MarshalIndent(record, "", "  ")
+		if err != nil {
+			logrus.Fatalf("Error encoding run: %v", err)
+		}
+		os.Stdout.Write(append(enc, '\n'))
+		return
+	}
+
+	// Tests are marked flaky from the runs before this run
+	records, err := history.List()
+	if err != nil {
+		logrus.Fatalf("Error listing runs: %v", err)
+	}
+	if err := runner.WriteRunRecord(os.Stdout, record, runner.Flakiness(runsBefore(records, record))); err != nil {
+		logrus.Fatalf("Error writing run: %v", err)
+	}
+}
+
+// flakyMain lists the tests which have flipped between
+// passing and failing across the recorded runs
+func flakyMain(args []string) {
+	fs := flag.NewFlagSet("flaky", flag.ExitOnError)
+	history := openHistory(fs, args)
+
+	records, err := history.List()
+	if err != nil {
+		logrus.Fatalf("Error listing runs: %v", err)
+	}
+	if err := runner.WriteFlakiness(os.Stdout, runner.Flakiness(records)); err != nil {
+		logrus.Fatalf("Error writing flaky tests: %v", err)
+	}
+}
+
+// compareMain compares the test results of two recorded runs,
+// exiting with an error when the second run has regressions
+func compareMain(args []string) {
+	var asJSON bool
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.BoolVar(&asJSON, "json", false, "Print the comparison as JSON")
+	history := openHistory(fs, args)
+
+	if fs.NArg() != 2 {
+		logrus.Fatalf("Expected two runs to compare, got %d", fs.NArg())
+	}
+	before, err := history.GetMerged(fs.Arg(0))
+	if err != nil {
+		logrus.Fatalf("Error getting run: %v", err)
+	}
+	after, err := history.GetMerged(fs.Arg(1))
+	if err != nil {
+		logrus.Fatalf("Error getting run: %v", err)
+	}
+
+	c := runner.CompareRuns(before, after)
+	if asJSON {
+		enc, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			logrus.Fatalf("Error encoding comparison: %v", err)
+		}
+		os.Stdout.Write(append(enc, '\n'))
+	} else if err := runner.WriteComparison(os.Stdout, c); err != nil {
+		logrus.Fatalf("Error writing comparison: %v", err)
+	}
+
+	if len(c.Regressions) > 0 {
+		os.Exit(1)
+	}
+}
+
+// runsBefore returns the records of the runs started
+// before the given run.
+func runsBefore(records []runner.RunRecord, run runner.RunRecord) []runner.RunRecord {
+	var before []runner.RunRecord
+	for _, record := range records {
+		if record.Started.Before(run.Started) {
+			before = append(before, record)
+		}
+	}
+	return before
+}
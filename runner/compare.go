@@ -0,0 +1,361 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	// durationChangeRatio is the relative change in the duration
+	// of a test or instance considered significant
+	durationChangeRatio = 0.5
+
+	// minDurationChange is the smallest absolute change in
+	// duration considered significant
+	minDurationChange = time.Second
+)
+
+// TestChange is a test whose result differs between two runs. When
+// the test is empty the change is the outcome of the instance, such
+// as an instance failing before any tests were run.
+type TestChange struct {
+	Suite    string `json:"suite"`
+	Instance string `json:"instance"`
+	Test     string `json:"test"`
+
+	// Upgrade is the upgrade stage the test was run in
+	Upgrade string `json:"upgrade,omitempty"`
+
+	// Before and After are the statuses of the test, or the phases
+	// of the instance, in the first and second run, empty if the
+	// test is not in the run
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// DurationChange is a significant change in the duration of a
+// test or, when the test is empty, the tests of an instance.
+type DurationChange struct {
+	Suite    string        `json:"suite"`
+	Instance string        `json:"instance"`
+	Test     string        `json:"test,omitempty"`
+	Upgrade  string        `json:"upgrade,omitempty"`
+	Before   time.Duration `json:"before"`
+	After    time.Duration `json:"after"`
+}
+
+// VersionChange is an instance run with a different docker
+// version in each run
+type VersionChange struct {
+	Suite    string `json:"suite"`
+	Instance string `json:"instance"`
+	Before   string `json:"before"`
+	After    string `json:"after"`
+}
+
+// Comparison is the difference in the test results of two runs
+type Comparison struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+
+	Versions        []VersionChange  `json:"versions,omitempty"`
+	Regressions     []TestChange     `json:"regressions,omitempty"`
+	Fixes           []TestChange     `json:"fixes,omitempty"`
+	Added           []TestChange     `json:"added,omitempty"`
+	Removed         []TestChange     `json:"removed,omitempty"`
+	DurationChanges []DurationChange `json:"durationchanges,omitempty"`
+}
+
+// CompareRuns compares the results of two runs, lining up tests
+// by suite, instance, upgrade stage, and test name. Reruns should
+// be merged with the run they repeated using MergeRerun first.
+func CompareRuns(before, after RunRecord) Comparison {
+	c := Comparison{
+		Before: before.ID,
+		After:  after.ID,
+	}
+
+	beforeInstances := instanceRecords(before)
+	afterInstances := instanceRecords(after)
+
+	for _, key := range sortedInstanceKeys(beforeInstances, afterInstances) {
+		bi, inBefore := beforeInstances[key]
+		ai, inAfter := afterInstances[key]
+		if inBefore && inAfter && bi.DockerVersion != ai.DockerVersion {
+			c.Versions = append(c.Versions, VersionChange{
+				Suite:    key.suite,
+				Instance: key.instance,
+				Before:   bi.DockerVersion,
+				After:    ai.DockerVersion,
+			})
+		}
+		if inBefore && inAfter {
+			change := TestChange{
+				Suite:    key.suite,
+				Instance: key.instance,
+				Before:   string(bi.Phase),
+				After:    string(ai.Phase),
+			}
+			switch {
+			case bi.Phase == PhasePassed && ai.Phase == PhaseFailed:
+				c.Regressions = append(c.Regressions, change)
+			case bi.Phase == PhaseFailed && ai.Phase == PhasePassed:
+				c.Fixes = append(c.Fixes, change)
+			}
+		}
+
+		beforeResults := testResults(bi.Results)
+		afterResults := testResults(ai.Results)
+		for _, test := range sortedTestKeys(beforeResults, afterResults) {
+			br, inBefore := beforeResults[test]
+			ar, inAfter := afterResults[test]
+			change := TestChange{
+				Suite:    key.suite,
+				Instance: key.instance,
+				Test:     test.name,
+				Upgrade:  test.upgrade,
+				Before:   br.Status,
+				After:    ar.Status,
+			}
+			switch {
+			case !inBefore:
+				c.Added = append(c.Added, change)
+			case !inAfter:
+				c.Removed = append(c.Removed, change)
+			case br.Status != TestFailed && ar.Status == TestFailed:
+				c.Regressions = append(c.Regressions, change)
+			case br.Status == TestFailed && ar.Status != TestFailed:
+				c.Fixes = append(c.Fixes, change)
+			}
+			if inBefore && inAfter && significantChange(br.Duration, ar.Duration) {
+				c.DurationChanges = append(c.DurationChanges, DurationChange{
+					Suite:    key.suite,
+					Instance: key.instance,
+					Test:     test.name,
+					Upgrade:  test.upgrade,
+					Before:   br.Duration,
+					After:    ar.Duration,
+				})
+			}
+		}
+
+		if inBefore && inAfter {
+			bd, ad := bi.Durations[PhaseTests], ai.Durations[PhaseTests]
+			if significantChange(bd, ad) {
+				c.DurationChanges = append(c.DurationChanges, DurationChange{
+					Suite:    key.suite,
+					Instance: key.instance,
+					Before:   bd,
+					After:    ad,
+				})
+			}
+		}
+	}
+
+	return c
+}
+
+// significantChange returns whether the change between two
+// durations is significant, unknown durations are not compared
+func significantChange(before, after time.Duration) bool {
+	if before <= 0 || after <= 0 {
+		return false
+	}
+	diff := after - before
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff >= minDurationChange && float64(diff) >= durationChangeRatio*float64(before)
+}
+
+type instanceKey struct {
+	suite    string
+	instance string
+}
+
+func instanceRecords(record RunRecord) map[instanceKey]InstanceRecord {
+	instances := make(map[instanceKey]InstanceRecord, len(record.Instances))
+	for _, instance := range record.Instances {
+		instances[instanceKey{suite: instance.Suite, instance: instance.Name}] = instance
+	}
+	return instances
+}
+
+func sortedInstanceKeys(a, b map[instanceKey]InstanceRecord) []instanceKey {
+	seen := map[instanceKey]struct{}{}
+	var keys []instanceKey
+	for _, m := range []map[instanceKey]InstanceRecord{a, b} {
+		for key := range m {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Sort(byInstanceKey(keys))
+	return keys
+}
+
+// testKey identifies a test within an instance, the same test
+// may be run both before and after an upgrade
+type testKey struct {
+	upgrade string
+	name    string
+}
+
+// testResults maps the results by upgrade stage and test name,
+// when a test has multiple results the last result is used
+func testResults(results []TestResult) map[testKey]TestResult {
+	m := make(map[testKey]TestResult, len(results))
+	for _, result := range results {
+		m[testKey{upgrade: result.Upgrade, name: result.Name}] = result
+	}
+	return m
+}
+
+func sortedTestKeys(a, b map[testKey]TestResult) []testKey {
+	var keys []testKey
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Sort(byTestKey(keys))
+	return keys
+}
+
+type byTestKey []testKey
+
+func (b byTestKey) Len() int { return len(b) }
+func (b byTestKey) Less(i, j int) bool {
+	if b[i].upgrade != b[j].upgrade {
+		return b[i].upgrade < b[j].upgrade
+	}
+	return b[i].name < b[j].name
+}
+func (b byTestKey) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// MergeRerun merges the record of a rerun into the record of the
+// run it repeated. Instances and tests which were not rerun keep
+// the results of the repeated run.
+func MergeRerun(parent, rerun RunRecord) RunRecord {
+	merged := rerun
+	reran := instanceRecords(rerun)
+	merged.Instances = nil
+	for _, instance := range parent.Instances {
+		key := instanceKey{suite: instance.Suite, instance: instance.Name}
+		if r, ok := reran[key]; ok {
+			instance = mergeInstance(instance, r)
+			delete(reran, key)
+		}
+		merged.Instances = append(merged.Instances, instance)
+	}
+	for _, instance := range rerun.Instances {
+		if _, ok := reran[instanceKey{suite: instance.Suite, instance: instance.Name}]; ok {
+			merged.Instances = append(merged.Instances, instance)
+		}
+	}
+	return merged
+}
+
+// mergeInstance merges the results of a rerun instance into the
+// results of the instance it repeated. When only the failed tests
+// were rerun, the durations of the repeated instance are kept.
+func mergeInstance(parent, rerun InstanceRecord) InstanceRecord {
+	merged := rerun
+	results := testResults(rerun.Results)
+	merged.Results = nil
+	var filtered bool
+	for _, result := range parent.Results {
+		if result.Status == TestFailed {
+			filtered = true
+		}
+		key := testKey{upgrade: result.Upgrade, name: result.Name}
+		if r, ok := results[key]; ok {
+			result = r
+			delete(results, key)
+		}
+		merged.Results = append(merged.Results, result)
+	}
+	for _, result := range rerun.Results {
+		if _, ok := results[testKey{upgrade: result.Upgrade, name: result.Name}]; ok {
+			merged.Results = append(merged.Results, result)
+		}
+	}
+	if filtered {
+		merged.Durations = parent.Durations
+	}
+	return merged
+}
+
+type byInstanceKey []instanceKey
+
+func (b byInstanceKey) Len() int { return len(b) }
+func (b byInstanceKey) Less(i, j int) bool {
+	if b[i].suite != b[j].suite {
+		return b[i].suite < b[j].suite
+	}
+	return b[i].instance < b[j].instance
+}
+func (b byInstanceKey) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// WriteComparison writes the comparison of two runs as text
+func WriteComparison(w io.Writer, c Comparison) error {
+	fmt.Fprintf(w, "Comparing run %s to %s\n", c.Before, c.After)
+	for _, v := range c.Versions {
+		fmt.Fprintf(w, "  %s/%s: docker %s -> %s\n", v.Suite, v.Instance, v.Before, v.After)
+	}
+
+	sections := []struct {
+		title   string
+		changes []TestChange
+	}{
+		{"Regressions", c.Regressions},
+		{"Fixes", c.Fixes},
+		{"New tests", c.Added},
+		{"Removed tests", c.Removed},
+	}
+	for _, section := range sections {
+		if len(section.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s (%d):\n", section.title, len(section.changes))
+		for _, change := range section.changes {
+			name := change.Test
+			if name == "" {
+				name = "instance"
+			}
+			if change.Upgrade != "" {
+				name = change.Upgrade + " upgrade: " + name
+			}
+			fmt.Fprintf(w, "  %s/%s: %s", change.Suite, change.Instance, name)
+			if change.Before != "" && change.After != "" {
+				fmt.Fprintf(w, " (%s -> %s)", change.Before, change.After)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if len(c.DurationChanges) > 0 {
+		fmt.Fprintf(w, "\nDuration changes (%d):\n", len(c.DurationChanges))
+		for _, change := range c.DurationChanges {
+			name := change.Test
+			if name == "" {
+				name = "all tests"
+			} else if change.Upgrade != "" {
+				name = change.Upgrade + " upgrade: " + name
+			}
+			fmt.Fprintf(w, "  %s/%s: %s %s -> %s\n", change.Suite, change.Instance, name, change.Before, change.After)
+		}
+	}
+
+	if len(c.Regressions) == 0 && len(c.Fixes) == 0 && len(c.Added) == 0 && len(c.Removed) == 0 && len(c.DurationChanges) == 0 {
+		fmt.Fprintln(w, "No differences")
+	}
+	return nil
+}
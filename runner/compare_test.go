@@ -0,0 +1,146 @@
+package runner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompareRuns(t *testing.T) {
+	record := func(id, version string, tests time.Duration, results ...TestResult) RunRecord {
+		return RunRecord{
+			ID: id,
+			Instances: []InstanceRecord{
+				{
+					InstanceStatus: InstanceStatus{
+						Name:      "registry",
+						Suite:     "registry",
+						Results:   results,
+						Durations: map[Phase]time.Duration{PhaseTests: tests},
+					},
+					DockerVersion: version,
+				},
+			},
+		}
+	}
+	before := record("a", "1.10.0", time.Minute,
+		TestResult{Name: "push", Status: TestPassed, Duration: time.Second},
+		TestResult{Name: "pull", Status: TestFailed, Duration: 10 * time.Second},
+		TestResult{Name: "login", Status: TestPassed},
+	)
+	after := record("b", "1.11.0-rc1", 70*time.Second,
+		TestResult{Name: "push", Status: TestFailed, Duration: 3 * time.Second},
+		TestResult{Name: "pull", Status: TestPassed, Duration: 11 * time.Second},
+		TestResult{Name: "logout", Status: TestPassed},
+	)
+
+	c := CompareRuns(before, after)
+	if len(c.Versions) != 1 || c.Versions[0].After != "1.11.0-rc1" {
+		t.Errorf("unexpected versions %#v", c.Versions)
+	}
+	if len(c.Regressions) != 1 || c.Regressions[0].Test != "push" {
+		t.Errorf("unexpected regressions %#v", c.Regressions)
+	}
+	if len(c.Fixes) != 1 || c.Fixes[0].Test != "pull" {
+		t.Errorf("unexpected fixes %#v", c.Fixes)
+	}
+	if len(c.Added) != 1 || c.Added[0].Test != "logout" {
+		t.Errorf("unexpected added tests %#v", c.Added)
+	}
+	if len(c.Removed) != 1 || c.Removed[0].Test != "login" {
+		t.Errorf("unexpected removed tests %#v", c.Removed)
+	}
+	// Only push changed by more than half its duration and a second
+	if len(c.DurationChanges) != 1 || c.DurationChanges[0].Test != "push" {
+		t.Errorf("unexpected duration changes %#v", c.DurationChanges)
+	}
+}
+
+func TestCompareRunsInstanceFailed(t *testing.T) {
+	record := func(id string, phase Phase, results ...TestResult) RunRecord {
+		return RunRecord{
+			ID: id,
+			Instances: []InstanceRecord{
+				{InstanceStatus: InstanceStatus{Name: "rc", Suite: "registry", Phase: phase, Results: results}},
+			},
+		}
+	}
+	// The daemon never started so no tests were run
+	before := record("a", PhasePassed, TestResult{Name: "push", Status: TestPassed})
+	after := record("b", PhaseFailed)
+
+	c := CompareRuns(before, after)
+	if len(c.Regressions) != 1 || c.Regressions[0].Test != "" || c.Regressions[0].After != string(PhaseFailed) {
+		t.Fatalf("unexpected regressions %#v", c.Regressions)
+	}
+	if len(c.Removed) != 1 || c.Removed[0].Test != "push" {
+		t.Errorf("unexpected removed tests %#v", c.Removed)
+	}
+
+	c = CompareRuns(after, before)
+	if len(c.Regressions) != 0 || len(c.Fixes) != 1 || c.Fixes[0].Test != "" {
+		t.Errorf("unexpected comparison %#v", c)
+	}
+}
+
+func TestCompareRunsUpgrade(t *testing.T) {
+	record := func(id string, before, after string) RunRecord {
+		return RunRecord{
+			ID: id,
+			Instances: []InstanceRecord{
+				{InstanceStatus: InstanceStatus{Name: "upgrade", Suite: "registry", Results: []TestResult{
+					{Name: "pull", Status: before, Upgrade: UpgradeBefore},
+					{Name: "pull", Status: after, Upgrade: UpgradeAfter},
+				}}},
+			},
+		}
+	}
+
+	c := CompareRuns(record("a", TestPassed, TestPassed), record("b", TestPassed, TestFailed))
+	if len(c.Regressions) != 1 || c.Regressions[0].Upgrade != UpgradeAfter {
+		t.Fatalf("unexpected regressions %#v", c.Regressions)
+	}
+	if len(c.Fixes) != 0 || len(c.Added) != 0 || len(c.Removed) != 0 {
+		t.Errorf("unexpected comparison %#v", c)
+	}
+}
+
+func TestMergeRerun(t *testing.T) {
+	parent := RunRecord{
+		ID: "a",
+		Instances: []InstanceRecord{
+			{InstanceStatus: InstanceStatus{Name: "registry-1", Suite: "registry", Phase: PhasePassed, Results: []TestResult{
+				{Name: "push", Status: TestPassed},
+			}}},
+			{InstanceStatus: InstanceStatus{Name: "registry-2", Suite: "registry", Phase: PhaseFailed, Results: []TestResult{
+				{Name: "push", Status: TestPassed},
+				{Name: "pull", Status: TestFailed},
+			}, Durations: map[Phase]time.Duration{PhaseTests: time.Minute}}},
+		},
+	}
+	rerun := RunRecord{
+		ID:      "b",
+		RerunOf: "a",
+		Instances: []InstanceRecord{
+			{InstanceStatus: InstanceStatus{Name: "registry-2", Suite: "registry", Phase: PhasePassed, Results: []TestResult{
+				{Name: "pull", Status: TestPassed},
+			}, Durations: map[Phase]time.Duration{PhaseTests: time.Second}}},
+		},
+	}
+
+	merged := MergeRerun(parent, rerun)
+	if merged.ID != "b" || len(merged.Instances) != 2 {
+		t.Fatalf("unexpected merged run %#v", merged)
+	}
+	instance := merged.Instances[1]
+	if instance.Phase != PhasePassed || instance.Durations[PhaseTests] != time.Minute {
+		t.Errorf("unexpected merged instance %#v", instance)
+	}
+
+	c := CompareRuns(parent, merged)
+	if len(c.Removed) != 0 || len(c.Regressions) != 0 {
+		t.Errorf("unexpected comparison %#v", c)
+	}
+	if len(c.Fixes) != 2 || c.Fixes[0].Test != "" || c.Fixes[1].Test != "pull" {
+		t.Errorf("unexpected fixes %#v", c.Fixes)
+	}
+}
@@ -0,0 +1,115 @@
+package runner
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	// ComposeBuildNoCache builds compose images without
+	// using the build cache, this is the default
+	ComposeBuildNoCache = "nocache"
+
+	// ComposeBuildCache builds compose images using the
+	// build cache of the test daemon
+	ComposeBuildCache = "cache"
+
+	// ComposeBuildNone does not build compose images, all
+	// service images must already exist
+	ComposeBuildNone = "none"
+
+	// defaultComposeFile is the compose file used when
+	// none is configured
+	defaultComposeFile = "docker-compose.yml"
+)
+
+// ComposeConfiguration is the configuration for running
+// docker compose inside the test instance container.
+type ComposeConfiguration struct {
+	// Files are the compose files relative to the suite
+	// directory, later files override earlier ones.
+	Files []string `json:"files"`
+
+	// Overrides are compose files applied after Files
+	// for a single instance.
+	Overrides []string `json:"overrides,omitempty"`
+
+	// Project is the compose project name, if empty the
+	// name of the suite directory is used by compose.
+	Project string `json:"project,omitempty"`
+
+	// Build is how compose images are built before
+	// starting, if empty ComposeBuildNoCache is used.
+	Build string `json:"build,omitempty"`
+
+	// Plugin runs compose through the docker compose
+	// plugin rather than the docker-compose binary.
+	Plugin bool `json:"plugin,omitempty"`
+}
+
+// ComposeFiles returns the compose files in the order they
+// are given to compose, resolved relative to the directory.
+func (cc ComposeConfiguration) ComposeFiles(dir string) []string {
+	files := cc.Files
+	if len(files) == 0 {
+		files = []string{defaultComposeFile}
+	}
+	resolved := make([]string, 0, len(files)+len(cc.Overrides))
+	for _, f := range append(append([]string{}, files...), cc.Overrides...) {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(dir, f)
+		}
+		resolved = append(resolved, f)
+	}
+	return resolved
+}
+
+// validComposeBuild returns an error if the build mode is unknown
+func validComposeBuild(build string) error {
+	switch build {
+	case "", ComposeBuildNoCache, ComposeBuildCache, ComposeBuildNone:
+		return nil
+	}
+	return fmt.Errorf("invalid compose build %q, expected %q, %q, or %q", build, ComposeBuildNoCache, ComposeBuildCache, ComposeBuildNone)
+}
+
+// mergeComposeConfiguration merges two compose configurations, the
+// files are replaced when set in the override and the instance
+// overrides are appended.
+func mergeComposeConfiguration(base, override *ComposeConfiguration) *ComposeConfiguration {
+	if base == nil {
+		return override
+	}
+	if override == nil {
+		return base
+	}
+	merged := *base
+	if len(override.Files) > 0 {
+		merged.Files = override.Files
+	}
+	merged.Overrides = append(append([]string{}, base.Overrides...), override.Overrides...)
+	if override.Project != "" {
+		merged.Project = override.Project
+	}
+	if override.Build != "" {
+		merged.Build = override.Build
+	}
+	merged.Plugin = merged.Plugin || override.Plugin
+	return &merged
+}
+
+// composeCommand returns the compose command for the files
+// with the compose subcommand and arguments.
+func composeCommand(cc ComposeConfiguration, files []string, args ...string) []string {
+	command := []string{"docker-compose"}
+	if cc.Plugin {
+		command = []string{"docker", "compose"}
+	}
+	for _, f := range files {
+		command = append(command, "-f", f)
+	}
+	if cc.Project != "" {
+		command = append(command, "-p", cc.Project)
+	}
+	return append(command, args...)
+}
@@ -0,0 +1,325 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockerclient "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	composeServiceLabel = "com.docker.compose.service"
+	composeExitCodes    = "exit-codes"
+)
+
+// composeLogCollector captures the logs of each compose service
+// into a separate file using the daemon API.
+type composeLogCollector struct {
+	client *dockerclient.Client
+	dir    string
+
+	// logFile is called with each file written by the collector
+	logFile func(string)
+
+	wg      sync.WaitGroup
+	l       sync.Mutex
+	writers map[string]*serviceLogWriter
+
+	// following are the containers whose log
+	// streams have not ended
+	following map[string]struct{}
+
+	// events receives the daemon events used to follow
+	// compose containers started after Start
+	events     chan *dockerclient.APIEvents
+	stopEvents chan struct{}
+	eventsDone chan struct{}
+}
+
+// serviceLogWriter is a log file shared by all the
+// containers of a compose service.
+type serviceLogWriter struct {
+	l      sync.Mutex
+	f      *os.File
+	w      *redactingWriter
+	closed bool
+}
+
+func (w *serviceLogWriter) Write(p []byte) (int, error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	return w.w.Write(p)
+}
+
+func (w *serviceLogWriter) Close() error {
+	w.l.Lock()
+	defer w.l.Unlock()
+	w.closed = true
+	if err := w.w.Flush(); err != nil {
+		logrus.Errorf("Error writing log file: %v", err)
+	}
+	return w.f.Close()
+}
+
+// newComposeLogCollector creates a log collector which writes
+// service logs into the directory, calling logFile with the name
+// of each file written.
+func newComposeLogCollector(client *dockerclient.Client, dir string, logFile func(string)) (*composeLogCollector, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating compose log directory: %v", err)
+	}
+	return &composeLogCollector{
+		client:    client,
+		dir:       dir,
+		logFile:   logFile,
+		writers:   map[string]*serviceLogWriter{},
+		following: map[string]struct{}{},
+	}, nil
+}
+
+// composeContainers returns all the containers created by compose
+func composeContainers(client *dockerclient.Client) ([]dockerclient.APIContainers, error) {
+	listOptions := dockerclient.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"label": {composeServiceLabel},
+		},
+	}
+	containers, err := client.ListContainers(listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error listing containers: %v", err)
+	}
+	return containers, nil
+}
+
+// Start follows the logs of all compose containers, each line is
+// written with a timestamp to compose/<service>.log. Containers
+// started later, such as by a test scaling a service or a restart
+// policy, are followed until the collector is closed.
+func (c *composeLogCollector) Start() error {
+	c.events = make(chan *dockerclient.APIEvents, 16)
+	c.stopEvents = make(chan struct{})
+	c.eventsDone = make(chan struct{})
+	if err := c.client.AddEventListener(c.events); err != nil {
+		close(c.eventsDone)
+		return fmt.Errorf("error listening for container events: %v", err)
+	}
+	go c.watchEvents()
+
+	containers, err := composeContainers(c.client)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if err := c.follow(container.ID, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchEvents follows the compose containers started
+// until the collector stops watching events
+func (c *composeLogCollector) watchEvents() {
+	defer close(c.eventsDone)
+	for {
+		select {
+		case event, ok := <-c.events:
+			if !ok {
+				logrus.Errorf("Container event stream ended, no longer following new compose containers")
+				return
+			}
+			if event.Status != "start" {
+				continue
+			}
+			// A restarted container only logs from its start
+			if err := c.follow(event.ID, event.Time); err != nil {
+				logrus.Errorf("Error following started container: %v", err)
+			}
+		case <-c.stopEvents:
+			return
+		}
+	}
+}
+
+// follow follows the logs of the container since the given time,
+// containers not created by compose or already followed are ignored.
+func (c *composeLogCollector) follow(id string, since int64) error {
+	info, err := c.client.InspectContainer(id)
+	if err != nil {
+		return fmt.Errorf("error inspecting container %s: %v", id, err)
+	}
+	if info.Config == nil {
+		return nil
+	}
+	service, ok := info.Config.Labels[composeServiceLabel]
+	if !ok {
+		return nil
+	}
+	w, err := c.serviceWriter(service)
+	if err != nil {
+		return err
+	}
+
+	c.l.Lock()
+	if _, ok := c.following[id]; ok {
+		c.l.Unlock()
+		return nil
+	}
+	c.following[id] = struct{}{}
+	c.wg.Add(1)
+	c.l.Unlock()
+
+	go func() {
+		defer func() {
+			c.l.Lock()
+			delete(c.following, id)
+			c.l.Unlock()
+			c.wg.Done()
+		}()
+		logrus.Debugf("Following logs for %s container %s", service, id)
+		logsOptions := dockerclient.LogsOptions{
+			Container:    id,
+			OutputStream: w,
+			ErrorStream:  w,
+			Follow:       true,
+			Stdout:       true,
+			Stderr:       true,
+			Since:        since,
+			Timestamps:   true,
+			RawTerminal:  info.Config.Tty,
+		}
+		if err := c.client.Logs(logsOptions); err != nil {
+			logrus.Errorf("Error following logs for %s container %s: %v", service, id, err)
+		}
+	}()
+	return nil
+}
+
+func (c *composeLogCollector) serviceWriter(service string) (*serviceLogWriter, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if w, ok := c.writers[service]; ok {
+		return w, nil
+	}
+	f, err := os.Create(filepath.Join(c.dir, service+".log"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating log file for %s: %v", service, err)
+	}
+	c.logFile(f.Name())
+	w := &serviceLogWriter{f: f, w: newRedactingWriter(f)}
+	c.writers[service] = w
+	return w, nil
+}
+
+// Close stops following new containers, waits for the log streams
+// to end, and closes the log files.
+// The log streams end once the compose containers are stopped, any
+// containers still running after the stop timeout are killed.
+func (c *composeLogCollector) Close() error {
+	// No containers are followed once events are no longer watched
+	if c.events != nil {
+		if err := c.client.RemoveEventListener(c.events); err != nil {
+			logrus.Errorf("Error removing container event listener: %v", err)
+		}
+		close(c.stopEvents)
+		<-c.eventsDone
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		logrus.Errorf("Timed out waiting for compose logs after %s, killing containers", stopTimeout)
+		c.l.Lock()
+		for id := range c.following {
+			if err := c.client.KillContainer(dockerclient.KillContainerOptions{ID: id}); err != nil {
+				logrus.Errorf("Error killing container %s: %v", id, err)
+			}
+		}
+		c.l.Unlock()
+		select {
+		case <-done:
+		case <-time.After(stopTimeout):
+			// Writes after the files are closed are discarded
+			logrus.Errorf("Log streams still open after killing containers")
+		}
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	for service, w := range c.writers {
+		if err := w.Close(); err != nil {
+			logrus.Errorf("Error closing log file for %s: %v", service, err)
+		}
+	}
+	c.writers = map[string]*serviceLogWriter{}
+	return nil
+}
+
+// InspectContainers writes the inspect output of every compose
+// container to compose/<container>.json and the exit code of
+// each container to compose/exit-codes.
+func (c *composeLogCollector) InspectContainers() error {
+	containers, err := composeContainers(c.client)
+	if err != nil {
+		return err
+	}
+
+	lines := make([]string, 0, len(containers))
+	for _, container := range containers {
+		info, err := c.client.InspectContainer(container.ID)
+		if err != nil {
+			return fmt.Errorf("error inspecting container %s: %v", container.ID, err)
+		}
+		name := strings.TrimPrefix(info.Name, "/")
+		if err := writeJSONFile(filepath.Join(c.dir, name+".json"), info); err != nil {
+			return err
+		}
+		c.logFile(filepath.Join(c.dir, name+".json"))
+
+		service := container.Labels[composeServiceLabel]
+		logrus.Debugf("Compose container %s for %s exited with %d", name, service, info.State.ExitCode)
+		lines = append(lines, fmt.Sprintf("%s\t%s\t%d\t%s", service, name, info.State.ExitCode, info.State.String()))
+	}
+	sort.Strings(lines)
+
+	f, err := os.Create(filepath.Join(c.dir, composeExitCodes))
+	if err != nil {
+		return fmt.Errorf("error creating exit code file: %v", err)
+	}
+	defer f.Close()
+	c.logFile(f.Name())
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(f, line); err != nil {
+			return fmt.Errorf("error writing exit codes: %v", err)
+		}
+	}
+	return f.Close()
+}
+
+func writeJSONFile(filename string, v interface{}) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", filename, err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		return fmt.Errorf("error writing %s: %v", filename, err)
+	}
+	return f.Close()
+}
@@ -8,13 +8,16 @@ package runner
 // Command line flags
 
 import (
+	"crypto/rand"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/Sirupsen/logrus"
@@ -126,6 +129,12 @@ type ConfigurationManager struct {
 	flagResolver  *flagResolver
 	dockerVersion configurationVersion
 	suites        suites
+	selection     testSelection
+	streamImages  bool
+	cleanGraph    bool
+	keepOnFailure bool
+	debug         bool
+	mountSuite    bool
 }
 
 // NewConfigurationManager creates a new configuraiton manager
@@ -138,18 +147,24 @@ func NewConfigurationManager() *ConfigurationManager {
 	// TODO: support extra images
 	flag.Var(&m.dockerVersion, "docker-version", "Docker version to test")
 	flag.Var(m.suites, "s", "Path to test suite to run")
+	flag.BoolVar(&m.streamImages, "stream-images", false, "Stream images into base image instead of staging on disk")
+	flag.BoolVar(&m.cleanGraph, "clean", false, "Remove containers and unreferenced layers from cached docker graphs")
+	flag.BoolVar(&m.keepOnFailure, "keep-on-failure", false, "Leave failed instances running without tear down for debugging")
+	flag.BoolVar(&m.debug, "debug", false, "Open a debug shell in each instance before running the tests")
+	flag.BoolVar(&m.mountSuite, "mount-suite", false, "Mount suite directories in instances instead of copying, for development")
+	m.selection.register()
 
 	return m
 }
 
-// CreateRunner creates a new test runner from a docker load version
-// and cache configuration.
-func (c *ConfigurationManager) CreateRunner(loadDockerVersion versionutil.Version, cache CacheConfiguration) (TestRunner, error) {
+// CreateRunner creates a new test runner from a docker load version,
+// cache configuration, and output configuration.
+func (c *ConfigurationManager) CreateRunner(loadDockerVersion versionutil.Version, cache CacheConfiguration, output OutputConfiguration) (TestRunner, error) {
 	runConfig, err := c.runnerConfiguration(loadDockerVersion)
 	if err != nil {
 		return nil, err
 	}
-	return newRunner(runConfig, cache), nil
+	return newRunner(runConfig, cache, output), nil
 }
 
 // runnerConfiguration creates a runnerConfiguration resolving all the
@@ -197,9 +212,24 @@ func (c *ConfigurationManager) runnerConfiguration(loadDockerVersion versionutil
 		return runnerConfiguration{}, fmt.Errorf("error getting path to executable: %s", err)
 	}
 
+	if err := c.selection.validate(); err != nil {
+		return runnerConfiguration{}, err
+	}
+
+	runID, err := newRunID()
+	if err != nil {
+		return runnerConfiguration{}, fmt.Errorf("error generating run id: %s", err)
+	}
+
 	runnerConfig := runnerConfiguration{
+		RunID:          runID,
 		ExecutableName: "golem_runner",
 		ExecutablePath: executablePath,
+
+		CleanDockerGraph: c.cleanGraph,
+		KeepOnFailure:    c.keepOnFailure,
+		Debug:            c.debug,
+		MountSuite:       c.mountSuite,
 	}
 
 	for _, suite := range suites {
@@ -209,39 +239,71 @@ func (c *ConfigurationManager) runnerConfiguration(loadDockerVersion versionutil
 			Name:           resolver.Name(),
 			Path:           resolver.Path(),
 			DockerInDocker: resolver.Dind(),
+			Tags:           resolver.Tags(),
 		}
 
 		baseConf := BaseImageConfiguration{
 			Base:              resolver.BaseImage(),
 			ExtraImages:       resolver.Images(),
+			MirrorImages:      resolver.MirrorImages(),
 			DockerLoadVersion: loadDockerVersion,
 			DockerVersion:     versionutil.Version(c.dockerVersion),
+			StreamImages:      c.streamImages,
 		}
 
 		instances := resolver.Instances()
 
 		for idx, instance := range instances {
 			name := registrySuite.Name
-			if len(instances) > 1 {
+			if instance.Name != "" {
+				name = fmt.Sprintf("%s-%s", name, instance.Name)
+			} else if len(instances) > 1 {
 				name = fmt.Sprintf("%s-%d", name, idx+1)
 			}
 			imageConf := baseConf
 			imageConf.CustomImages = instance.CustomImages
+			imageConf.DaemonVersions = instance.DaemonVersions
+			imageConf.UpgradeFromVersion = instance.UpgradeFromVersion
+
+			tc := newTemplateContext(name, c.dockerVersion.String(), instance.CustomImages)
+			runConfig, err := tc.renderRunConfiguration(instance.RunConfiguration)
+			if err != nil {
+				return runnerConfiguration{}, fmt.Errorf("error rendering configuration for %s: %v", name, err)
+			}
 
 			conf := InstanceConfiguration{
 				Name:             name,
 				BaseImage:        imageConf,
-				RunConfiguration: instance.RunConfiguration,
+				RunConfiguration: runConfig,
+				Secrets:          instance.Secrets,
 			}
 			registrySuite.Instances = append(registrySuite.Instances, conf)
 		}
 
-		runnerConfig.Suites = append(runnerConfig.Suites, registrySuite)
+		if selected, ok := c.selection.selectSuite(registrySuite); ok {
+			runnerConfig.Suites = append(runnerConfig.Suites, selected)
+		} else {
+			logrus.Debugf("Skipping suite %s not matching filters", registrySuite.Name)
+		}
+	}
+
+	if len(runnerConfig.Suites) == 0 {
+		return runnerConfiguration{}, errors.New("no test instances match the filters")
 	}
 
 	return runnerConfig, nil
 }
 
+// newRunID generates a new identifier for a run. The identifier
+// sorts by creation time and is valid as an image tag.
+func newRunID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%x", time.Now().UTC().Format("20060102-150405"), b), nil
+}
+
 // Instance represents a single runnable test instance
 // including all prerun scripts, test commands, and Docker
 // images to include in instance. This structure will be
@@ -249,6 +311,21 @@ func (c *ConfigurationManager) runnerConfiguration(loadDockerVersion versionutil
 type Instance struct {
 	RunConfiguration
 	CustomImages []CustomImage
+
+	// Name is the name of the instance within its suite,
+	// appended to the suite name when set
+	Name string
+
+	// DaemonVersions are the docker versions to install
+	// for the instance's named daemons
+	DaemonVersions map[string]versionutil.Version
+
+	// UpgradeFromVersion is the docker version to install
+	// for running the daemon before an upgrade
+	UpgradeFromVersion versionutil.Version
+
+	// Secrets are the secrets to pass to the instance
+	Secrets []SecretConfiguration
 }
 
 // resolver is an interface for getting test configurations
@@ -258,12 +335,29 @@ type resolver interface {
 	Path() string
 	BaseImage() reference.NamedTagged
 	Dind() bool
+	Tags() []string
 	Images() []reference.NamedTagged
+	MirrorImages() []reference.NamedTagged
 	Instances() []Instance
 }
 
+type envList []string
+
+func (l *envList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *envList) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("invalid environment variable %q, expected \"KEY=value\"", value)
+	}
+	*l = append(*l, value)
+	return nil
+}
+
 type flagResolver struct {
 	customImages customImageMap
+	env          envList
 }
 
 func newFlagResolver() *flagResolver {
@@ -272,6 +366,7 @@ func newFlagResolver() *flagResolver {
 	}
 
 	flag.Var(fr.customImages, "i", "Set a custom image for running tests")
+	flag.Var(&fr.env, "env", "Set an environment variable for test instances")
 
 	return fr
 }
@@ -292,10 +387,18 @@ func (fr *flagResolver) Dind() bool {
 	return false
 }
 
+func (fr *flagResolver) Tags() []string {
+	return nil
+}
+
 func (fr *flagResolver) Images() []reference.NamedTagged {
 	return nil
 }
 
+func (fr *flagResolver) MirrorImages() []reference.NamedTagged {
+	return nil
+}
+
 func (fr *flagResolver) Instances() []Instance {
 	customImages := make([]CustomImage, 0, len(fr.customImages))
 	for _, ci := range fr.customImages {
@@ -303,6 +406,9 @@ func (fr *flagResolver) Instances() []Instance {
 	}
 	return []Instance{
 		{
+			RunConfiguration: RunConfiguration{
+				Env: fr.env,
+			},
 			CustomImages: customImages,
 		},
 	}
@@ -330,10 +436,18 @@ func (dr defaultResolver) Dind() bool {
 	return false
 }
 
+func (dr defaultResolver) Tags() []string {
+	return nil
+}
+
 func (dr defaultResolver) Images() []reference.NamedTagged {
 	return nil
 }
 
+func (dr defaultResolver) MirrorImages() []reference.NamedTagged {
+	return nil
+}
+
 func (dr defaultResolver) Instances() []Instance {
 	return nil
 }
@@ -387,6 +501,21 @@ func (mr multiResolver) Dind() bool {
 	return false
 }
 
+func (mr multiResolver) Tags() []string {
+	// Union of all tags
+	seen := map[string]struct{}{}
+	var tags []string
+	for _, r := range mr.resolvers {
+		for _, tag := range r.Tags() {
+			if _, ok := seen[tag]; !ok {
+				seen[tag] = struct{}{}
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
 func (mr multiResolver) Images() []reference.NamedTagged {
 	imageSet := map[string]reference.NamedTagged{}
 	// Merge all sets
@@ -402,34 +531,124 @@ func (mr multiResolver) Images() []reference.NamedTagged {
 	return images
 }
 
+func (mr multiResolver) MirrorImages() []reference.NamedTagged {
+	imageSet := map[string]reference.NamedTagged{}
+	// Merge all sets
+	for _, r := range mr.resolvers {
+		for _, named := range r.MirrorImages() {
+			imageSet[named.String()] = named
+		}
+	}
+	images := make([]reference.NamedTagged, 0, len(imageSet))
+	for _, named := range imageSet {
+		images = append(images, named)
+	}
+	return images
+}
+
 func (mr multiResolver) Instances() []Instance {
+	// A resolver with a single instance applies to every instance
+	var count int
+	for _, r := range mr.resolvers {
+		if n := len(r.Instances()); n > count {
+			count = n
+		}
+	}
+	if count == 0 {
+		count = 1
+	}
+	instances := make([]Instance, count)
+	for i := range instances {
+		instances[i] = mr.instance(i)
+	}
+	return instances
+}
+
+// instance merges the configuration of the instance at
+// the given index from each resolver.
+func (mr multiResolver) instance(index int) Instance {
 	// TODO: Expand images when there are multiple values for a target
 	imageSet := map[string]CustomImage{}
+	daemonVersions := map[string]versionutil.Version{}
+	var upgradeVersion versionutil.Version
+	var secrets []SecretConfiguration
+	var name string
 	runConfig := RunConfiguration{}
 	// Loop in reverse to ensure that base values get overwritten
 	for i := len(mr.resolvers) - 1; i >= 0; i-- {
-		for _, inst := range mr.resolvers[i].Instances() {
-			for _, ci := range inst.CustomImages {
-				imageSet[ci.Target.String()] = ci
-			}
-			runConfig.Setup = append(runConfig.Setup, inst.RunConfiguration.Setup...)
-			runConfig.TestRunner = append(runConfig.TestRunner, inst.RunConfiguration.TestRunner...)
+		resolved := mr.resolvers[i].Instances()
+		if len(resolved) == 0 {
+			continue
+		}
+		inst := resolved[len(resolved)-1]
+		if index < len(resolved) {
+			inst = resolved[index]
+		}
+		if inst.Name != "" {
+			name = inst.Name
+		}
+		for _, ci := range inst.CustomImages {
+			imageSet[ci.Target.String()] = ci
+		}
+		for name, v := range inst.DaemonVersions {
+			daemonVersions[name] = v
+		}
+		runConfig.Daemons = append(runConfig.Daemons, inst.RunConfiguration.Daemons...)
+		secrets = append(secrets, inst.Secrets...)
+		runConfig.SecretEnv = append(runConfig.SecretEnv, inst.RunConfiguration.SecretEnv...)
+		if inst.RunConfiguration.Upgrade != nil {
+			runConfig.Upgrade = inst.RunConfiguration.Upgrade
+			upgradeVersion = inst.UpgradeFromVersion
+		}
+		runConfig.Setup = append(runConfig.Setup, inst.RunConfiguration.Setup...)
+		runConfig.TestRunner = append(runConfig.TestRunner, inst.RunConfiguration.TestRunner...)
+		runConfig.SuiteEnv = append(runConfig.SuiteEnv, inst.RunConfiguration.SuiteEnv...)
+		runConfig.Env = append(runConfig.Env, inst.RunConfiguration.Env...)
+		runConfig.PostTest = append(runConfig.PostTest, inst.RunConfiguration.PostTest...)
+		runConfig.OnFailure = append(runConfig.OnFailure, inst.RunConfiguration.OnFailure...)
+		runConfig.Daemon = mergeDaemonConfiguration(runConfig.Daemon, inst.RunConfiguration.Daemon)
+		runConfig.LoadDaemon = mergeDaemonConfiguration(runConfig.LoadDaemon, inst.RunConfiguration.LoadDaemon)
+		runConfig.Compose = mergeComposeConfiguration(runConfig.Compose, inst.RunConfiguration.Compose)
+		runConfig.Ready = append(runConfig.Ready, inst.RunConfiguration.Ready...)
+		if inst.RunConfiguration.ReadyTimeout != 0 {
+			runConfig.ReadyTimeout = inst.RunConfiguration.ReadyTimeout
+		}
+		if inst.RunConfiguration.Shards != nil {
+			runConfig.Shards = inst.RunConfiguration.Shards
 		}
 	}
 	images := make([]CustomImage, 0, len(imageSet))
 	for _, ci := range imageSet {
 		images = append(images, ci)
 	}
-	// TODO: Keep multiple instances
 	// TODO: Squash runconfigurations for potential duplicates
-	return []Instance{
-		{
-			RunConfiguration: runConfig,
-			CustomImages:     images,
-		},
+	return Instance{
+		RunConfiguration: runConfig,
+		CustomImages:     images,
+		Name:             name,
+		DaemonVersions:   daemonVersions,
+
+		UpgradeFromVersion: upgradeVersion,
+
+		Secrets: secrets,
 	}
 }
 
+// mergeDaemonConfiguration merges two daemon configurations,
+// arguments and environment are appended and a non-empty
+// configuration file in the overriding configuration is used.
+func mergeDaemonConfiguration(base, override DaemonConfiguration) DaemonConfiguration {
+	merged := DaemonConfiguration{
+		Args:       append(append([]string{}, base.Args...), override.Args...),
+		Env:        append(append([]string{}, base.Env...), override.Env...),
+		ConfigFile: base.ConfigFile,
+	}
+	if override.ConfigFile != "" {
+		merged.ConfigFile = override.ConfigFile
+	}
+	return merged
+}
+
 // configurationSuite represents the configuration for
 // an entire test suite. The test suite may have multiple
 // instances
@@ -439,8 +658,17 @@ type configurationSuite struct {
 	path         string
 	base         reference.NamedTagged
 	images       []reference.NamedTagged
+	mirrorImages []reference.NamedTagged
 	customImages []CustomImage
 
+	daemonVersions map[string]versionutil.Version
+	upgradeVersion versionutil.Version
+
+	readyChecks  []ReadyCheck
+	readyTimeout time.Duration
+
+	shards *ShardConfiguration
+
 	resolvedName string
 }
 
@@ -464,35 +692,126 @@ func (cs *configurationSuite) Dind() bool {
 	return cs.config.Dind
 }
 
+func (cs *configurationSuite) Tags() []string {
+	return cs.config.Tags
+}
+
 func (cs *configurationSuite) Images() []reference.NamedTagged {
 	return cs.images
 }
+
+func (cs *configurationSuite) MirrorImages() []reference.NamedTagged {
+	return cs.mirrorImages
+}
+
 func (cs *configurationSuite) Instances() []Instance {
 	// TODO: Allow multiple instance configuration
 	runInstance := Instance{
 		CustomImages: cs.customImages,
 	}
-	for _, script := range cs.config.Pretest {
+	runInstance.Daemon = cs.config.Daemon.daemonConfiguration()
+	runInstance.LoadDaemon = cs.config.LoadDaemon.daemonConfiguration()
+	runInstance.DaemonVersions = cs.daemonVersions
+	for _, daemon := range cs.config.Daemons {
+		binary := "/usr/bin/docker"
+		if _, ok := cs.daemonVersions[daemon.Name]; ok {
+			binary = daemonBinary(daemon.Name)
+		}
+		runInstance.Daemons = append(runInstance.Daemons, NamedDaemonConfiguration{
+			DaemonConfiguration: DaemonConfiguration{
+				Args:       daemon.Args,
+				Env:        daemon.Env,
+				ConfigFile: daemon.Config,
+			},
+			Name:          daemon.Name,
+			Binary:        binary,
+			StorageDriver: daemon.StorageDriver,
+		})
+	}
+	if cs.config.Upgrade != nil {
+		runInstance.Upgrade = &UpgradeConfiguration{
+			Binary: upgradeBinary,
+			Before: testScripts(cs.config.Upgrade.Before),
+			After:  testScripts(cs.config.Upgrade.After),
+		}
+		runInstance.UpgradeFromVersion = cs.upgradeVersion
+	}
+	for _, secret := range cs.config.Secrets {
+		sc := secret.secretConfiguration()
+		runInstance.Secrets = append(runInstance.Secrets, sc)
+		if sc.As == SecretAsEnv {
+			runInstance.SecretEnv = append(runInstance.SecretEnv, sc.Name)
+		}
+	}
+	runInstance.SuiteEnv = cs.config.Env
+	runInstance.Setup = scripts(cs.config.Pretest)
+	runInstance.TestRunner = testScripts(cs.config.Runner)
+	runInstance.PostTest = scripts(cs.config.PostTest)
+	runInstance.OnFailure = scripts(cs.config.OnFailure)
+	if compose := cs.config.Compose; compose != nil {
+		runInstance.Compose = &ComposeConfiguration{
+			Files:     compose.Files,
+			Overrides: compose.Override,
+			Project:   compose.Project,
+			Build:     compose.Build,
+			Plugin:    compose.Plugin,
+		}
+	}
+	runInstance.Ready = cs.readyChecks
+	runInstance.ReadyTimeout = cs.readyTimeout
+	runInstance.Shards = cs.shards
+
+	if len(cs.config.Instances) == 0 {
+		return []Instance{runInstance}
+	}
+	instances := make([]Instance, 0, len(cs.config.Instances))
+	for _, ic := range cs.config.Instances {
+		instance := runInstance
+		instance.Name = ic.Name
+		instance.Env = ic.Env
+		if len(ic.ComposeOverride) > 0 {
+			var compose ComposeConfiguration
+			if runInstance.Compose != nil {
+				compose = *runInstance.Compose
+			}
+			compose.Overrides = append(append([]string{}, compose.Overrides...), ic.ComposeOverride...)
+			instance.Compose = &compose
+		}
+		instances = append(instances, instance)
+	}
+	return instances
+}
+
+func scripts(configs []pretestConfiguration) []Script {
+	scripts := make([]Script, 0, len(configs))
+	for _, script := range configs {
 		// TODO: respect quoted values
 		command := strings.Split(script.Command, " ")
-		runInstance.Setup = append(runInstance.Setup, Script{
+		scripts = append(scripts, Script{
 			Command: command,
 			Env:     script.Env,
 		})
 	}
-	for _, script := range cs.config.Runner {
+	return scripts
+}
+
+func testScripts(scripts []testRunConfiguration) []TestScript {
+	ts := make([]TestScript, 0, len(scripts))
+	for _, script := range scripts {
 		// TODO: respect quoted values
 		command := strings.Split(script.Command, " ")
-		runInstance.TestRunner = append(runInstance.TestRunner, TestScript{
+		ts = append(ts, TestScript{
 			Script: Script{
 				Command: command,
 				Env:     script.Env,
 			},
-			Format: script.Format,
+			Format:    script.Format,
+			Retries:   script.Retries,
+			Tags:      script.Tags,
+			FilterArg: script.FilterArg,
 		})
 	}
-
-	return []Instance{runInstance}
+	return ts
 }
 
 func newSuiteConfiguration(path string, config suiteConfiguration) (*configurationSuite, error) {
@@ -520,6 +839,160 @@ func newSuiteConfiguration(path string, config suiteConfiguration) (*configurati
 		}
 		images = append(images, named)
 	}
+	mirrorImages := make([]reference.NamedTagged, 0, len(config.Mirror))
+	for _, image := range config.Mirror {
+		named, err := getNamedTagged(image)
+		if err != nil {
+			return nil, err
+		}
+		mirrorImages = append(mirrorImages, named)
+	}
+
+	daemonVersions := map[string]versionutil.Version{}
+	daemonNames := map[string]struct{}{}
+	daemonEnvNames := map[string]string{}
+	for _, daemon := range config.Daemons {
+		if !daemonNameRegexp.MatchString(daemon.Name) {
+			return nil, fmt.Errorf("invalid daemon name %q", daemon.Name)
+		}
+		if daemon.Name == upgradeDaemonName {
+			return nil, fmt.Errorf("daemon name %q is reserved", daemon.Name)
+		}
+		if _, ok := daemonNames[daemon.Name]; ok {
+			return nil, fmt.Errorf("duplicate daemon name %q", daemon.Name)
+		}
+		daemonNames[daemon.Name] = struct{}{}
+		envName := namedDaemonEnvName(daemon.Name)
+		if other, ok := daemonEnvNames[envName]; ok {
+			return nil, fmt.Errorf("daemons %q and %q both use %s", other, daemon.Name, envName)
+		}
+		daemonEnvNames[envName] = daemon.Name
+		if daemon.Version != "" {
+			v, err := versionutil.ParseVersion(daemon.Version)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version for daemon %s: %v", daemon.Name, err)
+			}
+			daemonVersions[daemon.Name] = v
+		}
+	}
+
+	var upgradeVersion versionutil.Version
+	if config.Upgrade != nil {
+		if !config.Dind {
+			return nil, errors.New("upgrade requires dind")
+		}
+		if config.Upgrade.From == "" {
+			return nil, errors.New("upgrade requires a version to upgrade from")
+		}
+		v, err := versionutil.ParseVersion(config.Upgrade.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upgrade version: %v", err)
+		}
+		upgradeVersion = v
+	}
+
+	testRunners := config.Runner
+	if config.Upgrade != nil {
+		testRunners = append(append(append([]testRunConfiguration{}, testRunners...), config.Upgrade.Before...), config.Upgrade.After...)
+	}
+	for _, runner := range testRunners {
+		if err := runner.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	secretNames := map[string]struct{}{}
+	secrets := make([]secretConfiguration, 0, len(config.Secrets))
+	for _, secret := range config.Secrets {
+		if err := secret.secretConfiguration().validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := secretNames[secret.Name]; ok {
+			return nil, fmt.Errorf("duplicate secret name %q", secret.Name)
+		}
+		secretNames[secret.Name] = struct{}{}
+		// Secret files are relative to the suite directory
+		if secret.FromFile != "" && !filepath.IsAbs(secret.FromFile) {
+			secret.FromFile = filepath.Join(path, secret.FromFile)
+		}
+		secrets = append(secrets, secret)
+	}
+	config.Secrets = secrets
+
+	var composeFiles []string
+	if compose := config.Compose; compose != nil {
+		if err := validComposeBuild(compose.Build); err != nil {
+			return nil, err
+		}
+		composeFiles = append(append(composeFiles, compose.Files...), compose.Override...)
+	}
+	instanceNames := map[string]struct{}{}
+	for _, instance := range config.Instances {
+		if !daemonNameRegexp.MatchString(instance.Name) {
+			return nil, fmt.Errorf("invalid instance name %q", instance.Name)
+		}
+		if _, ok := instanceNames[instance.Name]; ok {
+			return nil, fmt.Errorf("duplicate instance name %q", instance.Name)
+		}
+		instanceNames[instance.Name] = struct{}{}
+		composeFiles = append(composeFiles, instance.ComposeOverride...)
+	}
+	if config.Compose != nil || len(composeFiles) > 0 {
+		if config.Compose == nil || len(config.Compose.Files) == 0 {
+			composeFiles = append(composeFiles, defaultComposeFile)
+		}
+		for _, f := range composeFiles {
+			if filepath.IsAbs(f) {
+				return nil, fmt.Errorf("compose file must be relative to the suite directory: %s", f)
+			}
+			if _, err := os.Stat(filepath.Join(path, f)); err != nil {
+				return nil, fmt.Errorf("error statting compose file: %v", err)
+			}
+		}
+	}
+
+	readyChecks := make([]ReadyCheck, 0, len(config.Ready))
+	for _, ready := range config.Ready {
+		rc, err := ready.readyCheck()
+		if err != nil {
+			return nil, err
+		}
+		readyChecks = append(readyChecks, rc)
+	}
+	var readyTimeout time.Duration
+	if config.ReadyTimeout != "" {
+		var err error
+		readyTimeout, err = time.ParseDuration(config.ReadyTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ready timeout: %v", err)
+		}
+	}
+
+	var shards *ShardConfiguration
+	if config.Shards < 0 {
+		return nil, fmt.Errorf("invalid number of shards: %d", config.Shards)
+	} else if config.Shards > 1 {
+		// The upgrade tests run against a single daemon graph
+		// and are not split across the shards
+		if config.Upgrade != nil {
+			return nil, errors.New("shards cannot be used with upgrade")
+		}
+		shards = &ShardConfiguration{
+			Total: config.Shards,
+			Files: config.ShardFiles,
+		}
+		if shards.Files == "" {
+			shards.Files = defaultShardFiles
+		}
+		if _, err := filepath.Match(shards.Files, ""); err != nil {
+			return nil, fmt.Errorf("invalid shard files %q: %v", shards.Files, err)
+		}
+		for _, runner := range config.Runner {
+			if !hasSuiteDirArg(strings.Split(runner.Command, " ")) {
+				return nil, fmt.Errorf("sharded test runner %q must have a \".\" argument for the shard's test files", runner.Command)
+			}
+		}
+	}
 
 	var base reference.NamedTagged
 	if config.Base != "" {
@@ -541,6 +1014,15 @@ func newSuiteConfiguration(path string, config suiteConfiguration) (*configurati
 		base:         base,
 		customImages: customImages,
 		images:       images,
+		mirrorImages: mirrorImages,
+
+		daemonVersions: daemonVersions,
+		upgradeVersion: upgradeVersion,
+
+		readyChecks:  readyChecks,
+		readyTimeout: readyTimeout,
+
+		shards: shards,
 
 		resolvedName: name,
 	}, nil
@@ -629,6 +1111,125 @@ type testRunConfiguration struct {
 	Command string   `toml:"command"`
 	Format  string   `toml:"format"`
 	Env     []string `toml:"env"`
+	Retries int      `toml:"retries"`
+
+	// Tags are used to select test runners to run
+	// with the -tag flag
+	Tags []string `toml:"tags"`
+
+	// FilterArg is the argument of the test command
+	// for only running tests matching a regular
+	// expression, such as "-f" for bats
+	FilterArg string `toml:"filterarg"`
+}
+
+// validate returns an error if retries are set on a test runner
+// whose results are not parsed, retries only rerun failed tests.
+func (trc testRunConfiguration) validate() error {
+	if trc.Retries > 0 && trc.Format != "tap" {
+		return fmt.Errorf("retries require format \"tap\" for test runner %q", trc.Command)
+	}
+	return nil
+}
+
+type daemonConfiguration struct {
+	Args   []string `toml:"args"`
+	Env    []string `toml:"env"`
+	Config string   `toml:"config"`
+}
+
+func (dc daemonConfiguration) daemonConfiguration() DaemonConfiguration {
+	return DaemonConfiguration{
+		Args:       dc.Args,
+		Env:        dc.Env,
+		ConfigFile: dc.Config,
+	}
+}
+
+var daemonNameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[_-][a-z0-9]+)*$`)
+
+type namedDaemonConfiguration struct {
+	Name          string   `toml:"name"`
+	Version       string   `toml:"version"`
+	StorageDriver string   `toml:"storagedriver"`
+	Args          []string `toml:"args"`
+	Env           []string `toml:"env"`
+	Config        string   `toml:"config"`
+}
+
+type upgradeConfiguration struct {
+	// From is the docker version to run before upgrading
+	// to the docker version under test
+	From string `toml:"from"`
+
+	Before []testRunConfiguration `toml:"before"`
+	After  []testRunConfiguration `toml:"after"`
+}
+
+type secretConfiguration struct {
+	Name     string `toml:"name"`
+	FromEnv  string `toml:"fromenv"`
+	FromFile string `toml:"fromfile"`
+	As       string `toml:"as"`
+}
+
+func (sc secretConfiguration) secretConfiguration() SecretConfiguration {
+	as := sc.As
+	if as == "" {
+		as = SecretAsEnv
+	}
+	return SecretConfiguration{
+		Name:     sc.Name,
+		FromEnv:  sc.FromEnv,
+		FromFile: sc.FromFile,
+		As:       as,
+	}
+}
+
+type composeConfiguration struct {
+	Files    []string `toml:"files"`
+	Override []string `toml:"override"`
+	Project  string   `toml:"project"`
+	Build    string   `toml:"build"`
+	Plugin   bool     `toml:"plugin"`
+}
+
+type readyConfiguration struct {
+	Service string `toml:"service"`
+	TCP     string `toml:"tcp"`
+	HTTP    string `toml:"http"`
+	Status  int    `toml:"status"`
+	Command string `toml:"command"`
+}
+
+func (rc readyConfiguration) readyCheck() (ReadyCheck, error) {
+	if rc.Service == "" {
+		return ReadyCheck{}, errors.New("ready check requires a service")
+	}
+	var configured int
+	for _, v := range []string{rc.TCP, rc.HTTP, rc.Command} {
+		if v != "" {
+			configured++
+		}
+	}
+	if configured != 1 {
+		return ReadyCheck{}, fmt.Errorf("ready check for %s must have exactly one of tcp, http, or command", rc.Service)
+	}
+	if rc.Status != 0 && rc.HTTP == "" {
+		return ReadyCheck{}, fmt.Errorf("ready check for %s has status without http", rc.Service)
+	}
+
+	check := ReadyCheck{
+		Service: rc.Service,
+		TCP:     rc.TCP,
+		HTTP:    rc.HTTP,
+		Status:  rc.Status,
+	}
+	if rc.Command != "" {
+		// TODO: respect quoted values
+		check.Command = strings.Split(rc.Command, " ")
+	}
+	return check, nil
 }
 
 type suiteConfiguration struct {
@@ -640,12 +1241,28 @@ type suiteConfiguration struct {
 	// inside the test container
 	Dind bool `toml:"dind"`
 
+	// Tags are used to select suites to run with
+	// the -tag flag
+	Tags []string `toml:"tags"`
+
 	// Base is the base image to build the test from
 	Base string `toml:"baseimage"`
 
+	// Env is the environment for all the commands run by the suite,
+	// the environment of a command overrides the suite environment
+	Env []string `toml:"env"`
+
 	// Pretest is the commands to run before the test starts
 	Pretest []pretestConfiguration `toml:"pretest"`
 
+	// PostTest is the commands to run after the test, these
+	// always run whether or not the test passed
+	PostTest []pretestConfiguration `toml:"posttest"`
+
+	// OnFailure is the commands to run after the test only
+	// when setup or the test failed
+	OnFailure []pretestConfiguration `toml:"onfailure"`
+
 	// Runner are the commands to run for the test. Each command
 	// must run without error for the suite to be considered passed.
 	// Each command may have a different output format.
@@ -658,6 +1275,70 @@ type suiteConfiguration struct {
 	// CustomImages allow runtime selection of an image inside the container
 	// automatically set dind to true
 	CustomImages []customimageConfiguration `toml:"customimage"`
+
+	// Mirror images are served by a registry mirror inside the test
+	// container. The test daemon uses the mirror when pulling so
+	// pulls of these images do not go over the network.
+	Mirror []string `toml:"mirror"`
+
+	// Daemon is the configuration for the docker daemon used
+	// by the tests
+	Daemon daemonConfiguration `toml:"daemon"`
+
+	// LoadDaemon is the configuration for the docker daemon used
+	// to load images into the test container
+	LoadDaemon daemonConfiguration `toml:"loaddaemon"`
+
+	// Daemons are additional named daemons to run in the test container,
+	// each may use a different version of docker than the test daemon
+	Daemons []namedDaemonConfiguration `toml:"extradaemon"`
+
+	// Upgrade configures an in-place upgrade test, the before tests
+	// run using the from version and the after tests run after the
+	// daemon under test is started on the same graph
+	Upgrade *upgradeConfiguration `toml:"upgrade"`
+
+	// Compose is the configuration for running docker compose,
+	// when not set docker-compose.yml is used if it exists
+	Compose *composeConfiguration `toml:"compose"`
+
+	// Secrets are read from the host when the tests are run
+	// and passed to the test container as environment
+	// variables or files, the values are redacted from logs
+	Secrets []secretConfiguration `toml:"secret"`
+
+	// Ready are readiness checks for compose services, the
+	// tests are not run until every check passes
+	Ready []readyConfiguration `toml:"ready"`
+
+	// ReadyTimeout is how long to wait for the readiness
+	// checks to pass, such as "2m"
+	ReadyTimeout string `toml:"readytimeout"`
+
+	// Shards is the number of instance containers the
+	// test files matching ShardFiles are split between
+	Shards     int    `toml:"shards"`
+	ShardFiles string `toml:"shardfiles"`
+
+	// Instances are the instances to run the suite's tests
+	// in, each with its own settings. When not set the
+	// suite has a single instance.
+	Instances []instanceConfiguration `toml:"instance"`
+}
+
+// instanceConfiguration is the configuration specific
+// to a single instance of a suite
+type instanceConfiguration struct {
+	// Name is appended to the suite name to name the instance
+	Name string `toml:"name"`
+
+	// ComposeOverride are compose files applied after the
+	// suite's compose files and overrides for this instance
+	ComposeOverride []string `toml:"composeoverride"`
+
+	// Env is the environment for this instance, overriding the
+	// suite env and overridden by the -env flag
+	Env []string `toml:"env"`
 }
 
 func assertTagged(image string) reference.NamedTagged {
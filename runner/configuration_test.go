@@ -0,0 +1,92 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSuiteInstances(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	for _, name := range []string{"docker-compose.yml", "tls.yml"} {
+		if err := ioutil.WriteFile(filepath.Join(td, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := suiteConfiguration{
+		Name: "registry",
+		Instances: []instanceConfiguration{
+			{Name: "plain"},
+			{Name: "tls", ComposeOverride: []string{"tls.yml"}, Env: []string{"SCHEME=https"}},
+		},
+	}
+	cs, err := newSuiteConfiguration(td, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := newMultiResolver(cs, globalDefault).Instances()
+	if len(instances) != 2 {
+		t.Fatalf("Expected 2 instances, got %d", len(instances))
+	}
+	if instances[0].Name != "plain" || instances[0].Compose != nil {
+		t.Fatalf("Unexpected first instance: %#v", instances[0])
+	}
+	if instances[1].Name != "tls" || instances[1].Compose == nil {
+		t.Fatalf("Unexpected second instance: %#v", instances[1])
+	}
+	if !reflect.DeepEqual(instances[1].Env, []string{"SCHEME=https"}) || len(instances[0].Env) != 0 {
+		t.Fatalf("Unexpected instance env: %v, %v", instances[0].Env, instances[1].Env)
+	}
+	expected := []string{filepath.Join(td, "docker-compose.yml"), filepath.Join(td, "tls.yml")}
+	if files := instances[1].Compose.ComposeFiles(td); !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Unexpected compose files\n\tExpected: %v\n\tActual:   %v", expected, files)
+	}
+
+	config.Instances = append(config.Instances, instanceConfiguration{Name: "tls"})
+	if _, err := newSuiteConfiguration(td, config); err == nil {
+		t.Fatalf("Expected error for duplicate instance name")
+	}
+	config.Instances = []instanceConfiguration{{Name: "missing", ComposeOverride: []string{"missing.yml"}}}
+	if _, err := newSuiteConfiguration(td, config); err == nil {
+		t.Fatalf("Expected error for missing compose override")
+	}
+}
+
+func TestTestRunnerRetries(t *testing.T) {
+	config := suiteConfiguration{
+		Name:   "retries",
+		Runner: []testRunConfiguration{{Command: "bats -t .", Format: "tap", Retries: 2}},
+	}
+	if _, err := newSuiteConfiguration("", config); err != nil {
+		t.Fatal(err)
+	}
+	config.Runner[0].Format = ""
+	if _, err := newSuiteConfiguration("", config); err == nil {
+		t.Fatalf("Expected error for retries without tap format")
+	}
+}
+
+func TestNamedDaemonNames(t *testing.T) {
+	config := suiteConfiguration{
+		Name:    "daemons",
+		Daemons: []namedDaemonConfiguration{{Name: "old"}, {Name: "new"}},
+	}
+	if _, err := newSuiteConfiguration("", config); err != nil {
+		t.Fatal(err)
+	}
+	config.Daemons = []namedDaemonConfiguration{{Name: upgradeDaemonName}}
+	if _, err := newSuiteConfiguration("", config); err == nil {
+		t.Fatalf("Expected error for reserved daemon name")
+	}
+	config.Daemons = []namedDaemonConfiguration{{Name: "a-b"}, {Name: "a_b"}}
+	if _, err := newSuiteConfiguration("", config); err == nil {
+		t.Fatalf("Expected error for daemon names with the same environment variable")
+	}
+}
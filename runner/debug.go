@@ -0,0 +1,171 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	dockerclient "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// runnerExecutable is the path of the golem runner
+	// inside the instance containers
+	runnerExecutable = "/usr/bin/golem_runner"
+
+	// defaultDockerHost is the address of the test daemon
+	defaultDockerHost = "unix:///var/run/docker.sock"
+)
+
+// DebugEnv returns the environment for a debug shell inside the
+// instance, the same environment the tests are run with along
+// with DOCKER_HOST set to the test daemon.
+func DebugEnv(rc RunConfiguration) []string {
+	return inheritEnv(rc.SuiteEnv, rc.Env, NamedDaemonEnv(rc.Daemons), []string{"DOCKER_HOST=" + defaultDockerHost})
+}
+
+// Hold reports the instance as held in the given phase, either
+// PhaseDebug or PhaseKept, and blocks until one of the signals is
+// received. The received signal is returned.
+func (sr *SuiteRunner) Hold(phase Phase, signals ...os.Signal) os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	defer signal.Stop(c)
+
+	finished := sr.startPhase(phase)
+	s := <-c
+	finished(nil)
+	logrus.Debugf("Received %s, continuing", s)
+	return s
+}
+
+// ContinueInstance signals an instance held in PhaseDebug
+// to continue running the tests.
+func ContinueInstance(client DockerClient, container string) error {
+	killOptions := dockerclient.KillContainerOptions{
+		ID:     container,
+		Signal: dockerclient.SIGUSR1,
+	}
+	if err := client.KillContainer(killOptions); err != nil {
+		return fmt.Errorf("error signaling container: %v", err)
+	}
+	return nil
+}
+
+// DebugShell opens an interactive shell inside the running instance
+// container, connected to the terminal of the golem process.
+func DebugShell(client DockerClient, container string) error {
+	cont, err := client.InspectContainer(container)
+	if err != nil {
+		return fmt.Errorf("error inspecting container: %v", err)
+	}
+	if !cont.State.Running {
+		return fmt.Errorf("container %s is not running", container)
+	}
+
+	tty := isTerminal(os.Stdin)
+	execOptions := dockerclient.CreateExecOptions{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          tty,
+		Cmd:          []string{runnerExecutable, "-shell"},
+		Container:    cont.ID,
+	}
+	e, err := client.CreateExec(execOptions)
+	if err != nil {
+		return fmt.Errorf("error creating exec: %v", err)
+	}
+
+	if tty {
+		restore, err := setRawTerminal()
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	success := make(chan struct{})
+	go func() {
+		<-success
+		if tty {
+			if height, width, ok := terminalSize(); ok {
+				if err := client.ResizeExecTTY(e.ID, height, width); err != nil {
+					logrus.Debugf("Error resizing exec tty: %v", err)
+				}
+			}
+		}
+		success <- struct{}{}
+	}()
+
+	startOptions := dockerclient.StartExecOptions{
+		InputStream:  os.Stdin,
+		OutputStream: os.Stdout,
+		ErrorStream:  os.Stderr,
+		Tty:          tty,
+		RawTerminal:  tty,
+		Success:      success,
+	}
+	if err := client.StartExec(e.ID, startOptions); err != nil {
+		return fmt.Errorf("error starting exec: %v", err)
+	}
+	return nil
+}
+
+// ExecShell replaces the current process with a shell
+// using the given environment
+func ExecShell(env []string) error {
+	shell := "/bin/sh"
+	if _, err := os.Stat("/bin/bash"); err == nil {
+		shell = "/bin/bash"
+	}
+	return syscall.Exec(shell, []string{shell}, env)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// setRawTerminal puts the terminal in raw mode, returning
+// a function to restore the previous terminal state
+func setRawTerminal() (func(), error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("error getting terminal state: %v", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, fmt.Errorf("error setting raw terminal: %v", err)
+	}
+	return func() {
+		if _, err := stty(state); err != nil {
+			logrus.Errorf("Error restoring terminal: %v", err)
+		}
+	}, nil
+}
+
+func terminalSize() (int, int, bool) {
+	size, err := stty("size")
+	if err != nil {
+		return 0, 0, false
+	}
+	var height, width int
+	if _, err := fmt.Sscanf(size, "%d %d", &height, &width); err != nil {
+		return 0, 0, false
+	}
+	return height, width, true
+}
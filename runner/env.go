@@ -0,0 +1,182 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// mergeEnv merges lists of environment variables, a variable
+// set in a later list overrides the same variable set earlier
+// while keeping the position of the first occurrence.
+func mergeEnv(envs ...[]string) []string {
+	var (
+		merged  []string
+		indexes = map[string]int{}
+	)
+	for _, env := range envs {
+		for _, kv := range env {
+			key := kv
+			if i := strings.Index(kv, "="); i >= 0 {
+				key = kv[:i]
+			}
+			if i, ok := indexes[key]; ok {
+				merged[i] = kv
+				continue
+			}
+			indexes[key] = len(merged)
+			merged = append(merged, kv)
+		}
+	}
+	return merged
+}
+
+// inheritEnv returns the environment of the current process
+// merged with the provided environment lists.
+func inheritEnv(envs ...[]string) []string {
+	return mergeEnv(append([][]string{os.Environ()}, envs...)...)
+}
+
+// templateContext is the data available to templated
+// commands and environment values in a run configuration.
+type templateContext struct {
+	// Instance is the name of the test instance
+	Instance string
+
+	// DockerVersion is the version of docker under test
+	DockerVersion string
+
+	customImages map[string]string
+}
+
+// CustomImage returns the source image used for the
+// custom image with the given target tag.
+func (tc templateContext) CustomImage(target string) (string, error) {
+	source, ok := tc.customImages[target]
+	if !ok {
+		return "", fmt.Errorf("no custom image for %s", target)
+	}
+	return source, nil
+}
+
+func newTemplateContext(instance string, dockerVersion string, customImages []CustomImage) templateContext {
+	tc := templateContext{
+		Instance:      instance,
+		DockerVersion: dockerVersion,
+		customImages:  map[string]string{},
+	}
+	for _, ci := range customImages {
+		tc.customImages[ci.Target.String()] = ci.Source
+	}
+	return tc
+}
+
+func (tc templateContext) render(value string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	tmpl, err := template.New("").Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template %q: %v", value, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, tc); err != nil {
+		return "", fmt.Errorf("error executing template %q: %v", value, err)
+	}
+	return buf.String(), nil
+}
+
+func (tc templateContext) renderAll(values []string) ([]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	rendered := make([]string, len(values))
+	for i, value := range values {
+		var err error
+		if rendered[i], err = tc.render(value); err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
+
+func (tc templateContext) renderScript(script Script) (Script, error) {
+	command, err := tc.renderAll(script.Command)
+	if err != nil {
+		return Script{}, err
+	}
+	env, err := tc.renderAll(script.Env)
+	if err != nil {
+		return Script{}, err
+	}
+	return Script{
+		Command: command,
+		Env:     env,
+	}, nil
+}
+
+func (tc templateContext) renderScripts(scripts []Script) ([]Script, error) {
+	if scripts == nil {
+		return nil, nil
+	}
+	rendered := make([]Script, len(scripts))
+	for i, script := range scripts {
+		var err error
+		if rendered[i], err = tc.renderScript(script); err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
+
+func (tc templateContext) renderTestScripts(scripts []TestScript) ([]TestScript, error) {
+	if scripts == nil {
+		return nil, nil
+	}
+	rendered := make([]TestScript, len(scripts))
+	for i, script := range scripts {
+		rendered[i] = script
+		var err error
+		if rendered[i].Script, err = tc.renderScript(script.Script); err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
+
+// renderRunConfiguration returns the run configuration with the
+// templates in the script commands and environment rendered.
+func (tc templateContext) renderRunConfiguration(rc RunConfiguration) (RunConfiguration, error) {
+	var err error
+	if rc.SuiteEnv, err = tc.renderAll(rc.SuiteEnv); err != nil {
+		return rc, err
+	}
+	if rc.Env, err = tc.renderAll(rc.Env); err != nil {
+		return rc, err
+	}
+	if rc.Setup, err = tc.renderScripts(rc.Setup); err != nil {
+		return rc, err
+	}
+	if rc.TestRunner, err = tc.renderTestScripts(rc.TestRunner); err != nil {
+		return rc, err
+	}
+	if rc.PostTest, err = tc.renderScripts(rc.PostTest); err != nil {
+		return rc, err
+	}
+	if rc.OnFailure, err = tc.renderScripts(rc.OnFailure); err != nil {
+		return rc, err
+	}
+	if rc.Upgrade != nil {
+		upgrade := *rc.Upgrade
+		if upgrade.Before, err = tc.renderTestScripts(upgrade.Before); err != nil {
+			return rc, err
+		}
+		if upgrade.After, err = tc.renderTestScripts(upgrade.After); err != nil {
+			return rc, err
+		}
+		rc.Upgrade = &upgrade
+	}
+	return rc, nil
+}
@@ -0,0 +1,343 @@
+package runner
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// EventVersion is the version of the event stream format. Readers
+// reject events with a newer version, fields may only be added to
+// events without incrementing the version.
+const EventVersion = 1
+
+const (
+	// eventsFile is the name of the file in the instance log
+	// directory which the runner writes the event stream to
+	eventsFile = "events.json"
+
+	// instanceOutput is the name of the file in the instance
+	// log directory which the container output is written to
+	instanceOutput = "output"
+)
+
+// EventType is the type of an event in the event stream
+type EventType string
+
+const (
+	// EventPhaseStarted is sent when an instance enters a phase
+	EventPhaseStarted EventType = "phase-started"
+
+	// EventPhaseFinished is sent when an instance completes a
+	// phase, including the duration and any error
+	EventPhaseFinished EventType = "phase-finished"
+
+	// EventScriptExited is sent when a script run by the
+	// instance exits, including the exit code and duration
+	EventScriptExited EventType = "script-exited"
+
+	// EventTestResult is sent for each test result parsed
+	// from the output of a test runner
+	EventTestResult EventType = "test-result"
+
+	// EventLogFile is sent when a log file is created in
+	// the instance log directory
+	EventLogFile EventType = "log-file"
+
+	// EventInstanceFinished is sent when an instance finishes
+	// with the passed or failed phase
+	EventInstanceFinished EventType = "instance-finished"
+)
+
+// Phase is the phase of running a test instance
+type Phase string
+
+const (
+	// PhaseBuilding is building the base and instance images
+	PhaseBuilding Phase = "building"
+
+	// PhaseStarting is starting the instance container
+	PhaseStarting Phase = "starting"
+
+	// PhaseLoading is loading images into the test daemon
+	PhaseLoading Phase = "loading"
+
+	// PhaseSetup is running setup scripts and starting
+	// the test daemons and compose services
+	PhaseSetup Phase = "setup"
+
+	// PhaseUpgradeStart is starting the upgraded test daemon
+	// during setup, including any migration of the graph
+	PhaseUpgradeStart Phase = "upgrade-start"
+
+	// PhaseTests is running the tests
+	PhaseTests Phase = "tests"
+
+	// PhasePostTest is running the post test and
+	// on failure scripts
+	PhasePostTest Phase = "posttest"
+
+	// PhaseTearDown is stopping the test daemons
+	// and compose services
+	PhaseTearDown Phase = "teardown"
+
+	// PhaseDebug is holding the instance before the tests
+	// are run while a debug shell is open
+	PhaseDebug Phase = "debug"
+
+	// PhaseKept is holding a failed instance before tear
+	// down so it may be debugged
+	PhaseKept Phase = "kept"
+
+	// PhasePassed is a finished instance whose tests passed
+	PhasePassed Phase = "passed"
+
+	// PhaseFailed is a finished instance which failed
+	PhaseFailed Phase = "failed"
+)
+
+// TestResult is the result of a single test parsed
+// from the output of a test runner.
+type TestResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+
+	// Duration is the time taken by the test, when
+	// known from the test output
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Upgrade is the upgrade stage the test was run in,
+	// UpgradeBefore or UpgradeAfter, empty for the tests
+	// of the test runners
+	Upgrade string `json:"upgrade,omitempty"`
+}
+
+const (
+	// UpgradeBefore is the stage of the tests run
+	// before the daemon is upgraded
+	UpgradeBefore = "before"
+
+	// UpgradeAfter is the stage of the tests run
+	// after the daemon is upgraded
+	UpgradeAfter = "after"
+)
+
+const (
+	// TestPassed is the status of a passed test
+	TestPassed = "pass"
+
+	// TestFailed is the status of a failed test
+	TestFailed = "fail"
+
+	// TestSkipped is the status of a skipped test
+	TestSkipped = "skip"
+
+	// TestFlaky is the status of a test which failed
+	// and then passed when retried
+	TestFlaky = "flaky"
+)
+
+// ScriptResult is the result of running a script
+type ScriptResult struct {
+	// Kind is the kind of script, such as "setup" or "test"
+	Kind     string   `json:"kind"`
+	Command  []string `json:"command"`
+	ExitCode int      `json:"exitcode"`
+}
+
+// Event is an event in the event stream of a test instance
+type Event struct {
+	Version  int       `json:"v"`
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance,omitempty"`
+
+	// Phase is the phase started or finished, or the
+	// final phase when the instance is finished
+	Phase Phase `json:"phase,omitempty"`
+
+	// Duration is the duration of a finished phase or script
+	Duration time.Duration `json:"duration,omitempty"`
+
+	Script *ScriptResult `json:"script,omitempty"`
+	Result *TestResult   `json:"result,omitempty"`
+
+	// LogFile is the path of a log file relative to
+	// the instance log directory
+	LogFile string `json:"logfile,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// EventReporter receives events for test instances
+type EventReporter interface {
+	Report(Event)
+}
+
+// EventHandlerFunc is a function receiving events
+type EventHandlerFunc func(Event)
+
+// Report calls the function with the event
+func (f EventHandlerFunc) Report(event Event) {
+	f(event)
+}
+
+type nopReporter struct{}
+
+func (nopReporter) Report(Event) {}
+
+// instanceReporter reports events for a single instance
+type instanceReporter struct {
+	instance string
+	reporter EventReporter
+}
+
+func (ir instanceReporter) Report(event Event) {
+	event.Instance = ir.instance
+	ir.reporter.Report(event)
+}
+
+// eventWriter writes events to a stream as newline
+// separated json.
+type eventWriter struct {
+	l sync.Mutex
+	e *json.Encoder
+}
+
+func (ew *eventWriter) Report(event Event) {
+	event.Version = EventVersion
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	ew.l.Lock()
+	defer ew.l.Unlock()
+	if err := ew.e.Encode(event); err != nil {
+		logrus.Errorf("Error writing event: %v", err)
+	}
+}
+
+// eventReporters reports each event to every reporter
+type eventReporters []EventReporter
+
+func (er eventReporters) Report(event Event) {
+	for _, reporter := range er {
+		reporter.Report(event)
+	}
+}
+
+// NewEventWriter creates an event reporter which writes the
+// event stream to the writer.
+func NewEventWriter(w io.Writer) EventReporter {
+	return &eventWriter{e: json.NewEncoder(w)}
+}
+
+// NewFileEventReporter creates an event reporter writing the
+// event stream to the events file in the log directory. Secret
+// values are redacted from the events.
+func NewFileEventReporter(logDir string) (EventReporter, io.Closer, error) {
+	f, err := os.Create(filepath.Join(logDir, eventsFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating events file: %v", err)
+	}
+	return NewEventWriter(newRedactingWriter(f)), f, nil
+}
+
+// decodeEvent decodes a single event from the event stream,
+// returning an error if the event version is not supported.
+func decodeEvent(b []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(b, &event); err != nil {
+		return Event{}, fmt.Errorf("error decoding event: %v", err)
+	}
+	if event.Version < 1 || event.Version > EventVersion {
+		return Event{}, fmt.Errorf("unsupported event version %d", event.Version)
+	}
+	return event, nil
+}
+
+// ReadEvents reads an event stream to the end, reporting
+// each event. Unsupported events are skipped.
+func ReadEvents(r io.Reader, reporter EventReporter) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if event, err := decodeEvent(line); err != nil {
+				logrus.Errorf("Skipping event: %v", err)
+			} else {
+				reporter.Report(event)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// followEvents reads events written by the runner inside the
+// instance container and reports them until stop is closed,
+// after which any remaining events are read.
+func followEvents(filename string, reporter EventReporter, stop <-chan struct{}) {
+	var (
+		f      *os.File
+		br     *bufio.Reader
+		buffer []byte
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	for {
+		stopped := false
+		select {
+		case <-stop:
+			stopped = true
+		case <-time.After(250 * time.Millisecond):
+		}
+
+		if f == nil {
+			var err error
+			if f, err = os.Open(filename); err != nil {
+				if !os.IsNotExist(err) {
+					logrus.Errorf("Error opening events file: %v", err)
+				}
+				f = nil
+				if stopped {
+					return
+				}
+				continue
+			}
+			br = bufio.NewReader(f)
+		}
+
+		for {
+			line, err := br.ReadBytes('\n')
+			buffer = append(buffer, line...)
+			if err != nil {
+				// Partial lines are completed on the next read
+				break
+			}
+			if event, err := decodeEvent(buffer); err != nil {
+				logrus.Errorf("Skipping event: %v", err)
+			} else {
+				reporter.Report(event)
+			}
+			buffer = buffer[:0]
+		}
+
+		if stopped {
+			return
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package runner
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewEventWriter(&buf)
+	w.Report(Event{Type: EventPhaseStarted, Phase: PhaseTests})
+	w.Report(Event{Type: EventTestResult, Result: &TestResult{Name: "push", Status: TestPassed}})
+	w.Report(Event{Type: EventScriptExited, Script: &ScriptResult{Kind: "test", Command: []string{"bats", "."}, ExitCode: 1}})
+	w.Report(Event{Type: EventPhaseFinished, Phase: PhaseTests, Duration: time.Second})
+	// Events from a newer version are skipped
+	buf.WriteString(`{"v":99,"type":"phase-started","phase":"unknown"}` + "\n")
+
+	m := NewMonitor()
+	if err := ReadEvents(&buf, instanceReporter{instance: "registry", reporter: m}); err != nil {
+		t.Fatal(err)
+	}
+
+	status, ok := m.Instance("registry")
+	if !ok {
+		t.Fatal("missing instance status")
+	}
+	if status.Phase != PhaseTests {
+		t.Errorf("unexpected phase %q", status.Phase)
+	}
+	if len(status.Results) != 1 || status.Results[0].Name != "push" {
+		t.Errorf("unexpected results %#v", status.Results)
+	}
+	if len(status.Scripts) != 1 || status.Scripts[0].ExitCode != 1 {
+		t.Errorf("unexpected scripts %#v", status.Scripts)
+	}
+	if status.Durations[PhaseTests] != time.Second {
+		t.Errorf("unexpected durations %#v", status.Durations)
+	}
+}
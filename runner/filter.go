@@ -0,0 +1,205 @@
+package runner
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l stringList) contains(value string) bool {
+	for _, v := range l {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (l stringList) containsAny(values []string) bool {
+	for _, v := range values {
+		if l.contains(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// testSelection is the subset of suites, instances,
+// and tests selected to run from the command line.
+type testSelection struct {
+	run       string
+	suites    stringList
+	instances stringList
+	tags      stringList
+}
+
+func (s *testSelection) register() {
+	flag.StringVar(&s.run, "run", "", "Only run tests with names matching the regular expression")
+	flag.Var(&s.suites, "suite", "Only run the named suite, may be repeated")
+	flag.Var(&s.instances, "instance", "Only run the named instance, may be repeated")
+	flag.Var(&s.tags, "tag", "Only run suites and test runners with the tag, may be repeated")
+}
+
+// empty returns whether no selection flags were given
+func (s *testSelection) empty() bool {
+	return s.run == "" && len(s.suites) == 0 && len(s.instances) == 0 && len(s.tags) == 0
+}
+
+func (s *testSelection) validate() error {
+	if s.run == "" {
+		return nil
+	}
+	if _, err := regexp.Compile(s.run); err != nil {
+		return fmt.Errorf("invalid test filter %q: %v", s.run, err)
+	}
+	return nil
+}
+
+// selectSuite returns the suite with only the selected
+// instances and test runners, returning false if no
+// instances of the suite are selected. When selecting
+// by tag, every test runner of a tagged suite is run,
+// otherwise only the tagged test runners are run.
+func (s *testSelection) selectSuite(suite SuiteConfiguration) (SuiteConfiguration, bool) {
+	if len(s.suites) > 0 && !s.suites.contains(suite.Name) {
+		return SuiteConfiguration{}, false
+	}
+
+	var instances []InstanceConfiguration
+	for _, instance := range suite.Instances {
+		if len(s.instances) > 0 && !s.instances.contains(instance.Name) {
+			continue
+		}
+		if len(s.tags) > 0 && !s.tags.containsAny(suite.Tags) {
+			var tagged []TestScript
+			for _, script := range instance.TestRunner {
+				if s.tags.containsAny(script.Tags) {
+					tagged = append(tagged, script)
+				}
+			}
+			if len(tagged) == 0 {
+				continue
+			}
+			instance.TestRunner = tagged
+		}
+		if s.run != "" {
+			instance.RunConfiguration = filterTests(instance.RunConfiguration, s.run)
+		}
+		instances = append(instances, instance)
+	}
+	if len(instances) == 0 {
+		return SuiteConfiguration{}, false
+	}
+	suite.Instances = instances
+	return suite, true
+}
+
+// testFilter returns a regular expression matching
+// only the given test names
+func testFilter(tests []string) string {
+	quoted := make([]string, len(tests))
+	for i, test := range tests {
+		quoted[i] = regexp.QuoteMeta(test)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
+
+// filterTests returns the run configuration with the
+// filter set on every test script
+func filterTests(rc RunConfiguration, filter string) RunConfiguration {
+	rc.TestRunner = setFilter(rc.TestRunner, filter)
+	if rc.Upgrade != nil {
+		upgrade := *rc.Upgrade
+		upgrade.Before = setFilter(upgrade.Before, filter)
+		upgrade.After = setFilter(upgrade.After, filter)
+		rc.Upgrade = &upgrade
+	}
+	return rc
+}
+
+// filterFailedTests returns the run configuration with the test
+// scripts of each upgrade stage filtered to the failed tests of
+// that stage. Stages without failed tests are run in full, such
+// as the tests before an upgrade which create the state checked
+// by the failed tests after the upgrade.
+func filterFailedTests(rc RunConfiguration, failed map[string][]string) RunConfiguration {
+	if tests := failed[""]; len(tests) > 0 {
+		rc.TestRunner = setFilter(rc.TestRunner, testFilter(tests))
+	}
+	if rc.Upgrade != nil {
+		upgrade := *rc.Upgrade
+		if tests := failed[UpgradeBefore]; len(tests) > 0 {
+			upgrade.Before = setFilter(upgrade.Before, testFilter(tests))
+		}
+		if tests := failed[UpgradeAfter]; len(tests) > 0 {
+			upgrade.After = setFilter(upgrade.After, testFilter(tests))
+		}
+		rc.Upgrade = &upgrade
+	}
+	return rc
+}
+
+// setFilter returns a copy of the test scripts with the filter set
+func setFilter(scripts []TestScript, filter string) []TestScript {
+	filtered := make([]TestScript, len(scripts))
+	for i, script := range scripts {
+		script.Filter = filter
+		filtered[i] = script
+	}
+	return filtered
+}
+
+// filterCommand returns the test command with the arguments
+// to only run the tests matching the script's filter. The
+// filter argument is inserted after the command, or after
+// the subcommand for go test. When the script does not set
+// the filter argument it is known for bats and go test,
+// other test commands are run unfiltered.
+func filterCommand(script TestScript) []string {
+	command := script.Command
+	if script.Filter == "" {
+		return command
+	}
+	insertAt, filterArg := 1, script.FilterArg
+	switch filepath.Base(command[0]) {
+	case "bats":
+		if filterArg == "" {
+			filterArg = "-f"
+		}
+	case "go":
+		if len(command) > 1 && command[1] == "test" {
+			insertAt = 2
+			if filterArg == "" {
+				filterArg = "-run"
+			}
+		}
+	}
+	if filterArg == "" {
+		logrus.Warnf("No filter argument for %s, running all tests", command[0])
+		return command
+	}
+
+	filtered := make([]string, 0, len(command)+2)
+	filtered = append(filtered, command[:insertAt]...)
+	if strings.HasSuffix(filterArg, "=") {
+		filtered = append(filtered, filterArg+script.Filter)
+	} else {
+		filtered = append(filtered, filterArg, script.Filter)
+	}
+	return append(filtered, command[insertAt:]...)
+}
@@ -0,0 +1,99 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectSuite(t *testing.T) {
+	script := func(name string, tags ...string) TestScript {
+		return TestScript{Script: Script{Command: []string{"bats", "-t", name}}, Tags: tags}
+	}
+	suite := SuiteConfiguration{
+		Name: "registry",
+		Instances: []InstanceConfiguration{
+			{Name: "registry-1", RunConfiguration: RunConfiguration{TestRunner: []TestScript{script("push.bats", "fast"), script("token.bats", "slow")}}},
+			{Name: "registry-2", RunConfiguration: RunConfiguration{TestRunner: []TestScript{script("tls.bats", "slow")}}},
+		},
+	}
+
+	for _, tc := range []struct {
+		selection testSelection
+		expected  map[string][]string
+	}{
+		{testSelection{}, map[string][]string{"registry-1": {"push.bats", "token.bats"}, "registry-2": {"tls.bats"}}},
+		{testSelection{suites: stringList{"notary"}}, nil},
+		{testSelection{instances: stringList{"registry-2"}}, map[string][]string{"registry-2": {"tls.bats"}}},
+		{testSelection{tags: stringList{"fast"}}, map[string][]string{"registry-1": {"push.bats"}}},
+		{testSelection{tags: stringList{"registry"}}, nil},
+	} {
+		selected, ok := tc.selection.selectSuite(suite)
+		if ok != (tc.expected != nil) {
+			t.Errorf("%#v: unexpected selection %v", tc.selection, ok)
+			continue
+		}
+		instances := map[string][]string{}
+		for _, instance := range selected.Instances {
+			for _, script := range instance.TestRunner {
+				instances[instance.Name] = append(instances[instance.Name], script.Command[2])
+			}
+		}
+		if ok && !reflect.DeepEqual(instances, tc.expected) {
+			t.Errorf("%#v: unexpected instances %v", tc.selection, instances)
+		}
+	}
+
+	// Tagged suites run all test runners
+	suite.Tags = []string{"registry"}
+	selected, ok := (&testSelection{tags: stringList{"registry"}, run: "push"}).selectSuite(suite)
+	if !ok || len(selected.Instances) != 2 || len(selected.Instances[0].TestRunner) != 2 {
+		t.Fatalf("unexpected selection %#v", selected)
+	}
+	if filter := selected.Instances[0].TestRunner[1].Filter; filter != "push" {
+		t.Errorf("unexpected filter %q", filter)
+	}
+}
+
+func TestFilterCommand(t *testing.T) {
+	for _, tc := range []struct {
+		command   []string
+		filterArg string
+		expected  []string
+	}{
+		{[]string{"bats", "-t", "."}, "", []string{"bats", "-f", "^(a)$", "-t", "."}},
+		{[]string{"go", "test", "./..."}, "", []string{"go", "test", "-run", "^(a)$", "./..."}},
+		{[]string{"./run-tests.sh"}, "", []string{"./run-tests.sh"}},
+		{[]string{"./run-tests.sh", "-v"}, "--filter", []string{"./run-tests.sh", "--filter", "^(a)$", "-v"}},
+		{[]string{"go", "test", "./..."}, "-run=", []string{"go", "test", "-run=^(a)$", "./..."}},
+	} {
+		filtered := filterCommand(TestScript{Script: Script{Command: tc.command}, Filter: "^(a)$", FilterArg: tc.filterArg})
+		if !reflect.DeepEqual(filtered, tc.expected) {
+			t.Errorf("unexpected command %v, expected %v", filtered, tc.expected)
+		}
+	}
+}
+
+func TestFilterFailedTests(t *testing.T) {
+	script := func(name string) []TestScript {
+		return []TestScript{{Script: Script{Command: []string{"bats", "-t", name}}, Format: "tap"}}
+	}
+	rc := RunConfiguration{
+		TestRunner: script("."),
+		Upgrade:    &UpgradeConfiguration{Before: script("before.bats"), After: script("after.bats")},
+	}
+
+	// The tests before the upgrade create the state checked after
+	filtered := filterFailedTests(rc, map[string][]string{UpgradeAfter: {"pull"}})
+	if filter := filtered.Upgrade.After[0].Filter; filter != "^(pull)$" {
+		t.Errorf("Unexpected after upgrade filter %q", filter)
+	}
+	if filter := filtered.Upgrade.Before[0].Filter; filter != "" {
+		t.Errorf("Unexpected before upgrade filter %q", filter)
+	}
+	if filter := filtered.TestRunner[0].Filter; filter != "" {
+		t.Errorf("Unexpected test runner filter %q", filter)
+	}
+	if rc.Upgrade.After[0].Filter != "" {
+		t.Errorf("Unexpected filter set on original configuration")
+	}
+}
@@ -0,0 +1,128 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// TestFlakiness is how often a test changed between passing
+// and failing across runs of the same configuration.
+type TestFlakiness struct {
+	Instance string `json:"instance"`
+	Test     string `json:"test"`
+
+	// Runs is the number of runs the test has a result in
+	Runs int `json:"runs"`
+
+	// Failures is the number of runs the test failed in
+	Failures int `json:"failures"`
+
+	// Flips is the number of times the test passed after
+	// failing or failed after passing in consecutive runs
+	// with the same configuration digest, or was flaky
+	// within a run.
+	Flips int `json:"flips"`
+}
+
+// FlakyTests are the tests which have flipped between
+// passing and failing, most flaky first.
+type FlakyTests []TestFlakiness
+
+// IsFlaky returns whether the test is known to be
+// flaky for the instance.
+func (f FlakyTests) IsFlaky(instance, test string) bool {
+	for _, t := range f {
+		if t.Instance == instance && t.Test == test {
+			return true
+		}
+	}
+	return false
+}
+
+// Flakiness computes the flaky tests from the recorded results
+// of the given runs. Only results from runs with the same
+// configuration digest are compared to each other.
+func Flakiness(records []RunRecord) FlakyTests {
+	type testKey struct {
+		instance string
+		test     string
+	}
+	type configKey struct {
+		testKey
+		config string
+	}
+
+	// Walk runs from oldest to newest
+	ordered := make([]RunRecord, len(records))
+	copy(ordered, records)
+	sort.Sort(sort.Reverse(byRunStarted(ordered)))
+
+	tests := map[testKey]*TestFlakiness{}
+	last := map[configKey]string{}
+	for _, record := range ordered {
+		for _, instance := range record.Instances {
+			for _, result := range instance.Results {
+				if result.Status == TestSkipped {
+					continue
+				}
+				tk := testKey{instance: instance.Name, test: result.Name}
+				t, ok := tests[tk]
+				if !ok {
+					t = &TestFlakiness{Instance: instance.Name, Test: result.Name}
+					tests[tk] = t
+				}
+				t.Runs++
+
+				status := result.Status
+				switch status {
+				case TestFailed:
+					t.Failures++
+				case TestFlaky:
+					t.Flips++
+					status = TestPassed
+				}
+
+				ck := configKey{testKey: tk, config: record.ConfigDigest.String()}
+				if previous, ok := last[ck]; ok && previous != status {
+					t.Flips++
+				}
+				last[ck] = status
+			}
+		}
+	}
+
+	var flaky FlakyTests
+	for _, t := range tests {
+		if t.Flips > 0 {
+			flaky = append(flaky, *t)
+		}
+	}
+	sort.Sort(byFlips(flaky))
+	return flaky
+}
+
+// WriteFlakiness writes a table of the flaky tests
+func WriteFlakiness(w io.Writer, flaky FlakyTests) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tTEST\tRUNS\tFAILURES\tFLIPS")
+	for _, t := range flaky {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", t.Instance, t.Test, t.Runs, t.Failures, t.Flips)
+	}
+	return tw.Flush()
+}
+
+type byFlips FlakyTests
+
+func (b byFlips) Len() int { return len(b) }
+func (b byFlips) Less(i, j int) bool {
+	if b[i].Flips != b[j].Flips {
+		return b[i].Flips > b[j].Flips
+	}
+	if b[i].Instance != b[j].Instance {
+		return b[i].Instance < b[j].Instance
+	}
+	return b[i].Test < b[j].Test
+}
+func (b byFlips) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
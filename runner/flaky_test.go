@@ -0,0 +1,53 @@
+package runner
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestFlakyTests(t *testing.T) {
+	now := time.Now()
+	run := func(i int, config string, results ...TestResult) RunRecord {
+		return RunRecord{
+			ID:           fmt.Sprintf("run-%d", i),
+			Started:      now.Add(time.Duration(i) * time.Minute),
+			ConfigDigest: digest.Digest(config),
+			Instances: []InstanceRecord{
+				{InstanceStatus: InstanceStatus{Name: "registry", Results: results}},
+			},
+		}
+	}
+	pass := func(name string) TestResult { return TestResult{Name: name, Status: TestPassed} }
+	fail := func(name string) TestResult { return TestResult{Name: name, Status: TestFailed} }
+
+	records := []RunRecord{
+		// Newest first as listed from the history
+		run(4, "sha256:1", pass("push"), pass("pull"), TestResult{Name: "tag", Status: TestFlaky}),
+		run(3, "sha256:2", fail("push"), fail("pull"), pass("tag")),
+		run(2, "sha256:1", fail("push"), pass("pull"), pass("tag")),
+		run(1, "sha256:1", pass("push"), pass("pull"), pass("tag")),
+		run(0, "sha256:2", pass("push"), fail("pull"), pass("tag")),
+	}
+
+	flaky := Flakiness(records)
+	if len(flaky) != 2 {
+		t.Fatalf("unexpected flaky tests %#v", flaky)
+	}
+	// push flipped twice in config 1 and once in config 2,
+	// pull always failed with config 2 and passed with config 1
+	if flaky[0].Test != "push" || flaky[0].Flips != 3 || flaky[0].Failures != 2 || flaky[0].Runs != 5 {
+		t.Errorf("unexpected push flakiness %#v", flaky[0])
+	}
+	if flaky[1].Test != "tag" || flaky[1].Flips != 1 {
+		t.Errorf("unexpected tag flakiness %#v", flaky[1])
+	}
+	if flaky.IsFlaky("registry", "pull") {
+		t.Error("pull should not be flaky")
+	}
+	if !flaky.IsFlaky("registry", "push") {
+		t.Error("push should be flaky")
+	}
+}
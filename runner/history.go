@@ -0,0 +1,440 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/golem/buildutil"
+	"github.com/docker/golem/versionutil"
+)
+
+const (
+	// historyFile is the name of the file in each run directory
+	// holding the record of the run.
+	historyFile = "run.json"
+
+	// LatestRun may be given in place of a run id to get
+	// the most recent run.
+	LatestRun = "latest"
+)
+
+// ImageSource is the source a custom image was exported
+// from for an instance.
+type ImageSource struct {
+	Target string `json:"target"`
+	Source string `json:"source"`
+}
+
+// InstanceRecord is the recorded result of a test instance
+// along with the versions and images it was run with.
+type InstanceRecord struct {
+	InstanceStatus
+
+	// LogDir is the directory the instance logs were
+	// collected into on the host.
+	LogDir string `json:"logdir"`
+
+	DockerVersion      string            `json:"dockerversion"`
+	DaemonVersions     map[string]string `json:"daemonversions,omitempty"`
+	UpgradeFromVersion string            `json:"upgradefromversion,omitempty"`
+	CustomImages       []ImageSource     `json:"customimages,omitempty"`
+}
+
+// RunRecord is the record of a golem run kept in the
+// run history.
+type RunRecord struct {
+	ID       string    `json:"id"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// ConfigDigest is the digest of the resolved suite
+	// configuration, runs with the same digest ran the
+	// same configuration.
+	ConfigDigest      digest.Digest `json:"configdigest"`
+	DockerLoadVersion string        `json:"dockerloadversion"`
+
+	// RerunOf is the id of the run whose failed
+	// tests were run again by this run.
+	RerunOf string `json:"rerunof,omitempty"`
+
+	Instances []InstanceRecord `json:"instances"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// Passed returns whether every instance in the run passed
+func (r RunRecord) Passed() bool {
+	if r.Error != "" {
+		return false
+	}
+	for _, instance := range r.Instances {
+		if instance.Phase != PhasePassed {
+			return false
+		}
+	}
+	return true
+}
+
+// History is the record of past runs stored alongside the
+// logs of each run in the runs directory.
+type History struct {
+	root string
+}
+
+// NewHistory creates a history stored in the given
+// runs directory.
+func NewHistory(root string) *History {
+	return &History{
+		root: root,
+	}
+}
+
+// Save writes the record of a run to the history, replacing
+// any existing record for the run.
+func (h *History) Save(record RunRecord) error {
+	dir := filepath.Join(h.root, record.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating run directory: %v", err)
+	}
+	b, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding run record: %v", err)
+	}
+	tmp := filepath.Join(dir, historyFile+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("error writing run record: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, historyFile)); err != nil {
+		return fmt.Errorf("error saving run record: %v", err)
+	}
+	return nil
+}
+
+// List returns the records of all runs in the
+// history, most recent first.
+func (h *History) List() ([]RunRecord, error) {
+	entries, err := ioutil.ReadDir(h.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading history: %v", err)
+	}
+	var records []RunRecord
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		record, err := h.read(entry.Name())
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sort.Sort(byRunStarted(records))
+	return records, nil
+}
+
+// Get returns the record of the run with the given id. The id
+// may be a unique prefix of a run id or LatestRun.
+func (h *History) Get(id string) (RunRecord, error) {
+	records, err := h.List()
+	if err != nil {
+		return RunRecord{}, err
+	}
+	if id == LatestRun {
+		if len(records) == 0 {
+			return RunRecord{}, fmt.Errorf("no runs in history")
+		}
+		return records[0], nil
+	}
+	var matches []RunRecord
+	for _, record := range records {
+		if record.ID == id {
+			return record, nil
+		}
+		if strings.HasPrefix(record.ID, id) {
+			matches = append(matches, record)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return RunRecord{}, fmt.Errorf("no run found matching %q", id)
+	case 1:
+		return matches[0], nil
+	default:
+		return RunRecord{}, fmt.Errorf("ambiguous run %q matches %d runs", id, len(matches))
+	}
+}
+
+// GetMerged gets a run like Get, merging the results of a rerun
+// into the results of the runs it repeated.
+func (h *History) GetMerged(id string) (RunRecord, error) {
+	record, err := h.Get(id)
+	if err != nil {
+		return RunRecord{}, err
+	}
+	if record.RerunOf == "" {
+		return record, nil
+	}
+	parent, err := h.GetMerged(record.RerunOf)
+	if err != nil {
+		return RunRecord{}, fmt.Errorf("error getting run %s repeated by %s: %v", record.RerunOf, record.ID, err)
+	}
+	return MergeRerun(parent, record), nil
+}
+
+func (h *History) read(id string) (RunRecord, error) {
+	f, err := os.Open(filepath.Join(h.root, id, historyFile))
+	if err != nil {
+		return RunRecord{}, err
+	}
+	defer f.Close()
+	var record RunRecord
+	if err := json.NewDecoder(f).Decode(&record); err != nil {
+		return RunRecord{}, fmt.Errorf("error decoding run record %s: %v", id, err)
+	}
+	return record, nil
+}
+
+type byRunStarted []RunRecord
+
+func (b byRunStarted) Len() int { return len(b) }
+func (b byRunStarted) Less(i, j int) bool {
+	if b[i].Started.Equal(b[j].Started) {
+		return b[i].ID > b[j].ID
+	}
+	return b[i].Started.After(b[j].Started)
+}
+func (b byRunStarted) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// configDigest returns the digest of the parts of the runner
+// configuration which determine what is tested. Locally built
+// binaries keep their version when rebuilt, so the digests of
+// the cached docker binaries are included.
+func configDigest(config runnerConfiguration, buildCache buildutil.BuildCache) (digest.Digest, error) {
+	type instanceConfig struct {
+		Name               string
+		Base               string
+		Images             []string
+		MirrorImages       []string
+		CustomImages       []ImageSource
+		DockerVersion      string
+		DaemonVersions     map[string]string
+		UpgradeFromVersion string
+		Binaries           map[string]digest.Digest
+		Run                RunConfiguration
+		Secrets            []SecretConfiguration
+	}
+	type suiteConfig struct {
+		Name           string
+		Path           string
+		Args           []string
+		DockerInDocker bool
+		Instances      []instanceConfig
+	}
+
+	var suites []suiteConfig
+	for _, suite := range config.Suites {
+		sc := suiteConfig{
+			Name:           suite.Name,
+			Path:           suite.Path,
+			Args:           suite.Args,
+			DockerInDocker: suite.DockerInDocker,
+		}
+		for _, instance := range suite.Instances {
+			ic := instanceConfig{
+				Name:               instance.Name,
+				CustomImages:       imageSources(instance.BaseImage.CustomImages),
+				DockerVersion:      instance.BaseImage.DockerVersion.String(),
+				DaemonVersions:     versionStrings(instance.BaseImage),
+				UpgradeFromVersion: instance.BaseImage.UpgradeFromVersion.String(),
+				Run:                instance.RunConfiguration,
+				Secrets:            instance.Secrets,
+			}
+			binaries, err := binaryDigests(instance.BaseImage, buildCache)
+			if err != nil {
+				return "", err
+			}
+			ic.Binaries = binaries
+			if instance.BaseImage.Base != nil {
+				ic.Base = instance.BaseImage.Base.String()
+			}
+			for _, image := range instance.BaseImage.ExtraImages {
+				ic.Images = append(ic.Images, image.String())
+			}
+			for _, image := range instance.BaseImage.MirrorImages {
+				ic.MirrorImages = append(ic.MirrorImages, image.String())
+			}
+			sc.Instances = append(sc.Instances, ic)
+		}
+		suites = append(suites, sc)
+	}
+
+	b, err := json.Marshal(suites)
+	if err != nil {
+		return "", fmt.Errorf("error encoding configuration: %v", err)
+	}
+	return digest.FromBytes(b), nil
+}
+
+// binaryDigests returns the digests of the cached docker binaries
+// installed in the base image by binary name, binaries which are
+// not in the cache are omitted.
+func binaryDigests(conf BaseImageConfiguration, buildCache buildutil.BuildCache) (map[string]digest.Digest, error) {
+	if buildCache == nil {
+		return nil, nil
+	}
+	versions := map[string]versionutil.Version{
+		"docker": conf.DockerVersion,
+	}
+	for name, v := range conf.DaemonVersions {
+		versions[filepath.Base(daemonBinary(name))] = v
+	}
+	if conf.UpgradeFromVersion.Name != "" {
+		versions[filepath.Base(upgradeBinary)] = conf.UpgradeFromVersion
+	}
+	var digests map[string]digest.Digest
+	for name, v := range versions {
+		dgst, err := buildCache.Digest(v)
+		if err != nil {
+			return nil, fmt.Errorf("error getting digest of docker %s: %v", v, err)
+		}
+		if dgst == "" {
+			continue
+		}
+		if digests == nil {
+			digests = map[string]digest.Digest{}
+		}
+		digests[name] = dgst
+	}
+	return digests, nil
+}
+
+func imageSources(images []CustomImage) []ImageSource {
+	var sources []ImageSource
+	for _, image := range images {
+		sources = append(sources, ImageSource{
+			Target: image.Target.String(),
+			Source: image.Source,
+		})
+	}
+	return sources
+}
+
+func versionStrings(conf BaseImageConfiguration) map[string]string {
+	if len(conf.DaemonVersions) == 0 {
+		return nil
+	}
+	versions := make(map[string]string, len(conf.DaemonVersions))
+	for name, v := range conf.DaemonVersions {
+		versions[name] = v.String()
+	}
+	return versions
+}
+
+// WriteHistory writes a table of the given runs
+func WriteHistory(w io.Writer, records []RunRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSTARTED\tRESULT\tINSTANCES\tFAILED TESTS\tDURATION\tCONFIG")
+	for _, record := range records {
+		result := PhasePassed
+		if !record.Passed() {
+			result = PhaseFailed
+		}
+		var failed int
+		for _, instance := range record.Instances {
+			for _, test := range instance.Results {
+				if test.Status == TestFailed {
+					failed++
+				}
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", record.ID, record.Started.Local().Format("2006-01-02 15:04:05"), result, len(record.Instances), failed, record.Finished.Sub(record.Started), shortDigest(record.ConfigDigest))
+	}
+	return tw.Flush()
+}
+
+// WriteRunRecord writes the details of a run including
+// the versions, images, and results of each instance.
+// Failed tests which are known to be flaky are marked.
+func WriteRunRecord(w io.Writer, record RunRecord, flaky FlakyTests) error {
+	fmt.Fprintf(w, "Run:          %s\n", record.ID)
+	fmt.Fprintf(w, "Started:      %s\n", record.Started.Local().Format(time.RFC1123))
+	fmt.Fprintf(w, "Duration:     %s\n", record.Finished.Sub(record.Started))
+	fmt.Fprintf(w, "Config:       %s\n", record.ConfigDigest)
+	fmt.Fprintf(w, "Load version: %s\n", record.DockerLoadVersion)
+	if record.RerunOf != "" {
+		fmt.Fprintf(w, "Rerun of:     %s\n", record.RerunOf)
+	}
+	if record.Error != "" {
+		fmt.Fprintf(w, "Error:        %s\n", record.Error)
+	}
+
+	for _, instance := range record.Instances {
+		fmt.Fprintf(w, "\nInstance %s (suite %s): %s\n", instance.Name, instance.Suite, instance.Phase)
+		fmt.Fprintf(w, "  Docker version: %s\n", instance.DockerVersion)
+		for _, name := range sortedKeys(instance.DaemonVersions) {
+			fmt.Fprintf(w, "  Daemon %s version: %s\n", name, instance.DaemonVersions[name])
+		}
+		if instance.UpgradeFromVersion != "" {
+			fmt.Fprintf(w, "  Upgrade from: %s\n", instance.UpgradeFromVersion)
+		}
+		for _, image := range instance.CustomImages {
+			fmt.Fprintf(w, "  Image %s from %s\n", image.Target, image.Source)
+		}
+		for _, phase := range []Phase{PhaseBuilding, PhaseStarting, PhaseLoading, PhaseSetup, PhaseTests, PhasePostTest, PhaseTearDown} {
+			if d, ok := instance.Durations[phase]; ok {
+				fmt.Fprintf(w, "  %s: %s\n", phase, d)
+			}
+		}
+		if instance.LogDir != "" {
+			fmt.Fprintf(w, "  Logs: %s\n", instance.LogDir)
+			for _, logFile := range instance.LogFiles {
+				fmt.Fprintf(w, "    %s\n", logFile)
+			}
+		}
+		if instance.Error != "" {
+			fmt.Fprintf(w, "  Error: %s\n", instance.Error)
+		}
+		for _, result := range instance.Results {
+			var mark string
+			if result.Status == TestFailed {
+				mark = flakyMark(flaky, instance.Name, result.Name)
+			}
+			fmt.Fprintf(w, "  %s %s%s\n", strings.ToUpper(result.Status), result.Name, mark)
+		}
+	}
+	return nil
+}
+
+func shortDigest(dgst digest.Digest) string {
+	if dgst == "" {
+		return ""
+	}
+	hex := dgst.Hex()
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
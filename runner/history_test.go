@@ -0,0 +1,108 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/golem/buildutil"
+	"github.com/docker/golem/versionutil"
+)
+
+func TestHistory(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-history-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	h := NewHistory(td)
+	now := time.Now()
+	for i, id := range []string{"20160101-000000-aaaa", "20160102-000000-bbbb", "20160102-000000-bbcc"} {
+		record := RunRecord{
+			ID:      id,
+			Started: now.Add(time.Duration(i) * time.Minute),
+			Instances: []InstanceRecord{
+				{
+					InstanceStatus: InstanceStatus{Name: "registry", Phase: PhasePassed},
+					LogDir:         "/logs/registry",
+				},
+			},
+		}
+		if err := h.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Run directories without a record are ignored
+	if err := os.Mkdir(td+"/20160103-000000-dddd", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := h.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].ID != "20160102-000000-bbcc" {
+		t.Fatalf("unexpected records %#v", records)
+	}
+
+	latest, err := h.Get(LatestRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.ID != "20160102-000000-bbcc" {
+		t.Errorf("unexpected latest run %s", latest.ID)
+	}
+
+	record, err := h.Get("20160101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Passed() || record.Instances[0].LogDir != "/logs/registry" {
+		t.Errorf("unexpected record %#v", record)
+	}
+
+	if _, err := h.Get("20160102"); err == nil {
+		t.Error("expected error for ambiguous run")
+	}
+	if _, err := h.Get("2017"); err == nil {
+		t.Error("expected error for missing run")
+	}
+}
+
+func TestConfigDigestBinary(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-digest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	cache := buildutil.NewFSBuildCache(filepath.Join(td, "cache"))
+	v := versionutil.StaticVersion(1, 11, 0)
+	config := runnerConfiguration{
+		Suites: []SuiteConfiguration{{Name: "registry", Instances: []InstanceConfiguration{
+			{Name: "registry", BaseImage: BaseImageConfiguration{DockerVersion: v}},
+		}}},
+	}
+
+	digests := map[string]bool{}
+	for _, build := range []string{"build 1", "build 2"} {
+		binary := filepath.Join(td, "docker")
+		if err := ioutil.WriteFile(binary, []byte(build), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.PutVersion(v, binary); err != nil {
+			t.Fatal(err)
+		}
+		dgst, err := configDigest(config, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests[dgst.String()] = true
+	}
+	if len(digests) != 2 {
+		t.Fatalf("Unexpected configuration digests for rebuilt binary\n\tExpected: %d\n\tActual:   %d", 2, len(digests))
+	}
+}
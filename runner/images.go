@@ -0,0 +1,327 @@
+package runner
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	dockerclient "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// imagesArchive is the name of the multi-image archive
+	// staged in the images directory of the base image.
+	imagesArchive = "images.tar"
+
+	// imagesExtracted is the name of the directory in the
+	// images directory which holds a streamed image archive
+	// in its extracted form.
+	imagesExtracted = "save"
+
+	// mirrorTagMap is the name of the tag map for images
+	// which are only served by the registry mirror.
+	mirrorTagMap = "mirror.json"
+)
+
+// ensureImages ensures all the given images exist locally, pulling
+// any missing images concurrently. The returned image ids are in the
+// same order as the provided images.
+func ensureImages(client DockerClient, images []string) ([]string, error) {
+	var (
+		wg   sync.WaitGroup
+		ids  = make([]string, len(images))
+		errs = make([]error, len(images))
+	)
+	for i := range images {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = ensureImage(client, images[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("error ensuring image %s: %v", images[i], err)
+		}
+	}
+
+	return ids, nil
+}
+
+// exportImages exports all the given images into a single
+// archive. Layers shared between images are only stored once.
+func exportImages(client DockerClient, filename string, images []string) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating image tar file: %v", err)
+	}
+	defer f.Close()
+
+	logrus.Debugf("Exporting images %v to %s", images, filename)
+	eo := dockerclient.ExportImagesOptions{
+		Names:        images,
+		OutputStream: f,
+	}
+	if err := client.ExportImages(eo); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// buildStreamed builds an image with the daemon from the build
+// directory, exporting the given images straight into the build
+// context as entries of the extracted images directory rather than
+// staging the archive on disk. The built image is tagged with name
+// and its id returned.
+func buildStreamed(client DockerClient, dir, name string, images []string) (string, error) {
+	pr, pw := io.Pipe()
+	contextErr := make(chan error, 1)
+	go func() {
+		err := writeStreamedContext(client, pw, dir, images)
+		pw.CloseWithError(err)
+		contextErr <- err
+	}()
+
+	buildOptions := dockerclient.BuildImageOptions{
+		Name:           name,
+		InputStream:    pr,
+		OutputStream:   os.Stdout,
+		RmTmpContainer: true,
+	}
+	buildErr := client.BuildImage(buildOptions)
+	// Unblock the context writer if the build stopped reading
+	pr.CloseWithError(io.ErrClosedPipe)
+	err := <-contextErr
+	if buildErr != nil {
+		return "", fmt.Errorf("error building image: %v", buildErr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error writing build context: %v", err)
+	}
+
+	img, err := client.InspectImage(name)
+	if err != nil {
+		return "", fmt.Errorf("error inspecting built image: %v", err)
+	}
+	return img.ID, nil
+}
+
+// writeStreamedContext writes the build directory followed by the
+// entries of the exported images archive as a build context tar.
+func writeStreamedContext(client DockerClient, w io.Writer, dir string, images []string) error {
+	tw := tar.NewWriter(w)
+	if err := addDirectory(tw, dir); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	exportErr := make(chan error, 1)
+	go func() {
+		logrus.Debugf("Streaming images %v to build context", images)
+		eo := dockerclient.ExportImagesOptions{
+			Names:        images,
+			OutputStream: pw,
+		}
+		err := client.ExportImages(eo)
+		pw.CloseWithError(err)
+		exportErr <- err
+	}()
+
+	prefix := path.Join("images", imagesExtracted)
+	err := func() error {
+		tr := tar.NewReader(pr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error reading image archive: %v", err)
+			}
+			hdr.Name = path.Join(prefix, hdr.Name)
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Name += "/"
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+		}
+	}()
+	// Unblock the export if the archive was not fully read
+	pr.CloseWithError(io.ErrClosedPipe)
+	if exportErr := <-exportErr; err == nil && exportErr != nil {
+		err = fmt.Errorf("error exporting images: %v", exportErr)
+	}
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// loadImages loads the given images from the image archive found in
+// the image root. The archive may either be staged as a single tar
+// file or be extracted into a directory when the images were streamed.
+// The archive also holds the images only served by the registry mirror,
+// the archive manifest is filtered so only the given images are loaded.
+func loadImages(client *dockerclient.Client, imageRoot string, imageIDs []string) error {
+	var archive io.Reader
+	staged := filepath.Join(imageRoot, imagesArchive)
+	if f, err := os.Open(staged); err == nil {
+		defer f.Close()
+		logrus.Debugf("Loading images from %s", staged)
+		archive = f
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error opening image archive: %v", err)
+	} else {
+		extracted := filepath.Join(imageRoot, imagesExtracted)
+		if _, err := os.Stat(extracted); err != nil {
+			return fmt.Errorf("no image archive found in %s: %v", imageRoot, err)
+		}
+
+		logrus.Debugf("Loading images from %s", extracted)
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(tarDirectory(pw, extracted))
+		}()
+		defer pr.Close()
+		archive = pr
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(filterImageArchive(pw, archive, imageIDs))
+	}()
+	defer pr.Close()
+
+	return client.LoadImage(dockerclient.LoadImageOptions{InputStream: pr})
+}
+
+// filterImageArchive copies the image archive keeping only the given
+// images in the archive manifest. Layers which are only used by other
+// images are still copied but are not loaded by the daemon.
+func filterImageArchive(w io.Writer, r io.Reader, imageIDs []string) error {
+	keep := map[string]struct{}{}
+	for _, id := range imageIDs {
+		keep[transferTag(id)+".json"] = struct{}{}
+	}
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading image archive: %v", err)
+		}
+		if path.Clean(hdr.Name) != "manifest.json" {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var entries []map[string]json.RawMessage
+		if err := json.NewDecoder(tr).Decode(&entries); err != nil {
+			return fmt.Errorf("error decoding manifest.json: %v", err)
+		}
+		filtered := []map[string]json.RawMessage{}
+		for _, entry := range entries {
+			var config string
+			if err := json.Unmarshal(entry["Config"], &config); err != nil {
+				return fmt.Errorf("error decoding manifest.json config: %v", err)
+			}
+			if _, ok := keep[config]; ok {
+				filtered = append(filtered, entry)
+			} else {
+				logrus.Debugf("Skipping load of image %s", config)
+			}
+		}
+		b, err := json.Marshal(filtered)
+		if err != nil {
+			return err
+		}
+		hdr.Size = int64(len(b))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// tarDirectory writes the contents of the directory as a tar
+// archive with paths relative to the directory.
+func tarDirectory(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	if err := addDirectory(tw, dir); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// addDirectory adds the contents of the directory to the
+// tar archive with paths relative to the directory.
+func addDirectory(tw *tar.Writer, dir string) error {
+	walker := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	}
+	return filepath.Walk(dir, walker)
+}
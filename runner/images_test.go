@@ -0,0 +1,84 @@
+package runner
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestFilterImageArchive(t *testing.T) {
+	manifest, err := json.Marshal([]map[string]interface{}{
+		{"Config": "aaaa.json", "Layers": []string{"1111/layer.tar"}},
+		{"Config": "bbbb.json", "Layers": []string{"2222/layer.tar"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"1111/layer.tar", []byte("layer 1")},
+		{"2222/layer.tar", []byte("layer 2")},
+		{"manifest.json", manifest},
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, file := range files {
+		hdr := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(file.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The image bbbb is only served by the registry mirror
+	var filtered bytes.Buffer
+	if err := filterImageArchive(&filtered, &archive, []string{"sha256:aaaa"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	var configs []string
+	tr := tar.NewReader(&filtered)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name != "manifest.json" {
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var entries []struct{ Config string }
+		if err := json.NewDecoder(tr).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			configs = append(configs, entry.Config)
+		}
+	}
+
+	expected := []string{"1111/layer.tar", "2222/layer.tar", "manifest.json"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Unexpected archive entries\n\tExpected: %v\n\tActual:   %v", expected, names)
+	}
+	if expected := []string{"aaaa.json"}; !reflect.DeepEqual(configs, expected) {
+		t.Fatalf("Unexpected loaded images\n\tExpected: %v\n\tActual:   %v", expected, configs)
+	}
+}
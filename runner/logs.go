@@ -37,13 +37,16 @@ func NewConsoleLogCapturer() LogCapturer {
 }
 
 type fileLogger struct {
-	stdout io.WriteCloser
-	stderr io.WriteCloser
+	stdout    io.WriteCloser
+	stderr    io.WriteCloser
+	stdoutLog *redactingWriter
+	stderrLog *redactingWriter
 }
 
 // NewFileLogCapturer uses files as a logging backend.
 // Stdout and Stderr will be written to separate files
-// with suffixes "-stdout" and "-stderr".
+// with suffixes "-stdout" and "-stderr". Secret values
+// are redacted from the files.
 func NewFileLogCapturer(basename string) (LogCapturer, error) {
 	if err := os.MkdirAll(filepath.Dir(basename), 0755); err != nil {
 		return nil, err
@@ -57,20 +60,28 @@ func NewFileLogCapturer(basename string) (LogCapturer, error) {
 		return nil, err
 	}
 	return &fileLogger{
-		stdout: outF,
-		stderr: errF,
+		stdout:    outF,
+		stderr:    errF,
+		stdoutLog: newRedactingWriter(outF),
+		stderrLog: newRedactingWriter(errF),
 	}, nil
 }
 
 func (fl *fileLogger) Stdout() io.Writer {
-	return fl.stdout
+	return fl.stdoutLog
 }
 
 func (fl *fileLogger) Stderr() io.Writer {
-	return fl.stderr
+	return fl.stderrLog
 }
 
 func (fl *fileLogger) Close() error {
+	if err := fl.stdoutLog.Flush(); err != nil {
+		logrus.Errorf("Error flushing stdout: %v", err)
+	}
+	if err := fl.stderrLog.Flush(); err != nil {
+		logrus.Errorf("Error flushing stderr: %v", err)
+	}
 	if err := fl.stdout.Close(); err != nil {
 		logrus.Errorf("Error closing stdout: %v", err)
 	}
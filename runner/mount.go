@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	dockerclient "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// RunConfigurationEnv is the environment variable holding the
+	// run configuration of an instance when the suite is mounted
+	RunConfigurationEnv = "GOLEM_RUN_CONFIGURATION"
+
+	// runConfigurationFile is the path of the run configuration
+	// copied into the instance image
+	runConfigurationFile = "/instance.json"
+
+	// suiteDir is the path of the suite directory in the instance
+	suiteDir = "/runner"
+)
+
+// mountSuite bind mounts the suite directory read-only in the
+// instance container and passes the run configuration through
+// the environment rather than copying them into the image.
+func mountSuite(hc *dockerclient.HostConfig, config *dockerclient.Config, suite SuiteConfiguration, rc RunConfiguration) error {
+	b, err := json.Marshal(rc)
+	if err != nil {
+		return fmt.Errorf("error encoding configuration: %v", err)
+	}
+	hc.Binds = append(hc.Binds, fmt.Sprintf("%s:%s:ro", suite.Path, suiteDir))
+	config.Env = append(config.Env, RunConfigurationEnv+"="+string(b))
+	return nil
+}
+
+// ReadRunConfiguration reads the run configuration inside an
+// instance, from the environment when the suite is mounted
+// or otherwise from the file copied into the image.
+func ReadRunConfiguration() (RunConfiguration, error) {
+	var rc RunConfiguration
+	if env := os.Getenv(RunConfigurationEnv); env != "" {
+		if err := json.Unmarshal([]byte(env), &rc); err != nil {
+			return RunConfiguration{}, fmt.Errorf("error decoding instance configuration: %v", err)
+		}
+		return rc, nil
+	}
+
+	f, err := os.Open(runConfigurationFile)
+	if err != nil {
+		return RunConfiguration{}, fmt.Errorf("error opening instance file: %v", err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&rc); err != nil {
+		return RunConfiguration{}, fmt.Errorf("error decoding instance configuration: %v", err)
+	}
+	return rc, nil
+}
@@ -0,0 +1,38 @@
+package runner
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	dockerclient "github.com/fsouza/go-dockerclient"
+)
+
+func TestMountSuite(t *testing.T) {
+	rc := RunConfiguration{
+		TestRunner: []TestScript{{Command: []string{"bats", "-t", "."}, Tags: []string{"fast"}}},
+		Shards:     &ShardConfiguration{Total: 2, Files: "*.bats"},
+	}
+	hc := &dockerclient.HostConfig{}
+	config := &dockerclient.Config{}
+	if err := mountSuite(hc, config, SuiteConfiguration{Path: "/suites/one"}, rc); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"/suites/one:/runner:ro"}; !reflect.DeepEqual(hc.Binds, expected) {
+		t.Fatalf("Unexpected binds\n\tExpected: %v\n\tActual:   %v", expected, hc.Binds)
+	}
+	if len(config.Env) != 1 || !strings.HasPrefix(config.Env[0], RunConfigurationEnv+"=") {
+		t.Fatalf("Unexpected environment: %v", config.Env)
+	}
+
+	defer os.Unsetenv(RunConfigurationEnv)
+	os.Setenv(RunConfigurationEnv, strings.TrimPrefix(config.Env[0], RunConfigurationEnv+"="))
+	read, err := ReadRunConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, rc) {
+		t.Fatalf("Unexpected run configuration\n\tExpected: %#v\n\tActual:   %#v", rc, read)
+	}
+}
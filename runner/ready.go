@@ -0,0 +1,168 @@
+package runner
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockerclient "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	defaultReadyTimeout = 2 * time.Minute
+	readyInterval       = 500 * time.Millisecond
+	readyCheckTimeout   = 5 * time.Second
+)
+
+// ReadyCheck is a readiness check for a compose service. Exactly
+// one of TCP, HTTP, or Command is set.
+type ReadyCheck struct {
+	// Service is the name of the compose service being checked
+	Service string `json:"service"`
+
+	// TCP is an address which must accept connections
+	TCP string `json:"tcp,omitempty"`
+
+	// HTTP is a URL which must respond with the expected status
+	HTTP string `json:"http,omitempty"`
+
+	// Status is the expected HTTP status, 200 if not set
+	Status int `json:"status,omitempty"`
+
+	// Command is a command which must exit successfully
+	Command []string `json:"command,omitempty"`
+}
+
+func (rc ReadyCheck) String() string {
+	switch {
+	case rc.TCP != "":
+		return fmt.Sprintf("%s (tcp %s)", rc.Service, rc.TCP)
+	case rc.HTTP != "":
+		return fmt.Sprintf("%s (http %s)", rc.Service, rc.HTTP)
+	default:
+		return fmt.Sprintf("%s (command %v)", rc.Service, rc.Command)
+	}
+}
+
+// check runs the readiness check once, returning nil
+// if the service is ready.
+func (rc ReadyCheck) check() error {
+	switch {
+	case rc.TCP != "":
+		conn, err := net.DialTimeout("tcp", rc.TCP, readyCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case rc.HTTP != "":
+		client := &http.Client{
+			Timeout: readyCheckTimeout,
+			Transport: &http.Transport{
+				// Services commonly use self-signed certificates
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+		resp, err := client.Get(rc.HTTP)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		expected := rc.Status
+		if expected == 0 {
+			expected = http.StatusOK
+		}
+		if resp.StatusCode != expected {
+			return fmt.Errorf("unexpected status %d, expected %d", resp.StatusCode, expected)
+		}
+		return nil
+	case len(rc.Command) > 0:
+		out, err := exec.Command(rc.Command[0], rc.Command[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		return nil
+	default:
+		return fmt.Errorf("no check configured for %s", rc.Service)
+	}
+}
+
+// readyFailure is a readiness check which never passed
+// along with the last error from the check.
+type readyFailure struct {
+	check ReadyCheck
+	err   error
+}
+
+// waitForReady waits until all the readiness checks pass or the
+// timeout is reached, returning the checks which never passed.
+func waitForReady(checks []ReadyCheck, timeout time.Duration) []readyFailure {
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+	pending := make(map[int]error, len(checks))
+	for i := range checks {
+		pending[i] = nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		for i := range pending {
+			if err := checks[i].check(); err != nil {
+				pending[i] = err
+				continue
+			}
+			logrus.Debugf("Service ready: %s", checks[i])
+			delete(pending, i)
+		}
+		if len(pending) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(readyInterval)
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+	failed := make([]readyFailure, 0, len(pending))
+	for i := range checks {
+		if err, ok := pending[i]; ok {
+			failed = append(failed, readyFailure{check: checks[i], err: err})
+		}
+	}
+	return failed
+}
+
+// dumpServiceLogs writes the logs of all containers for the compose
+// service to the writer.
+func dumpServiceLogs(client *dockerclient.Client, service string, w io.Writer) error {
+	listOptions := dockerclient.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"label": {"com.docker.compose.service=" + service},
+		},
+	}
+	containers, err := client.ListContainers(listOptions)
+	if err != nil {
+		return fmt.Errorf("error listing containers: %v", err)
+	}
+	for _, container := range containers {
+		fmt.Fprintf(w, "==> Logs for %s container %s (%s)\n", service, container.ID, container.Status)
+		logsOptions := dockerclient.LogsOptions{
+			Container:    container.ID,
+			OutputStream: w,
+			ErrorStream:  w,
+			Stdout:       true,
+			Stderr:       true,
+			Tail:         "all",
+		}
+		if err := client.Logs(logsOptions); err != nil {
+			return fmt.Errorf("error getting logs for %s: %v", container.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,456 @@
+package runner
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
+	dockerclient "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	mediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeConfig   = "application/vnd.docker.container.image.v1+json"
+
+	// mediaTypeLayer is the media type of uncompressed layers, the
+	// layers are served as they are stored in the image archive
+	mediaTypeLayer = "application/vnd.docker.image.rootfs.diff.tar"
+
+	// transferRepository is the repository name used by the
+	// image registry when transferring images to a daemon.
+	transferRepository = "golem-images"
+)
+
+var errNoImageManifest = errors.New("image archive has no manifest")
+
+// imageContent provides access to the files of an image
+// archive created by docker save.
+type imageContent interface {
+	Open(name string) (io.ReadSeeker, int64, error)
+	Close() error
+}
+
+type dirContent struct {
+	root string
+}
+
+func (dc dirContent) Open(name string) (io.ReadSeeker, int64, error) {
+	f, err := os.Open(filepath.Join(dc.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (dirContent) Close() error {
+	return nil
+}
+
+// closeContent closes a reader opened from image content
+// if the reader holds an open file.
+func closeContent(r io.Reader) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+type tarEntry struct {
+	offset int64
+	size   int64
+}
+
+// tarContent provides access to the files inside an image
+// archive without extracting it. The archive is indexed
+// once and each file read directly from its offset.
+type tarContent struct {
+	f       *os.File
+	entries map[string]tarEntry
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func openTarContent(filename string) (*tarContent, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	entries := map[string]tarEntry{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error reading %s: %v", filename, err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		entries[path.Clean(hdr.Name)] = tarEntry{
+			offset: cr.n,
+			size:   hdr.Size,
+		}
+	}
+	return &tarContent{
+		f:       f,
+		entries: entries,
+	}, nil
+}
+
+func (tc *tarContent) Open(name string) (io.ReadSeeker, int64, error) {
+	e, ok := tc.entries[path.Clean(name)]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return io.NewSectionReader(tc.f, e.offset, e.size), e.size, nil
+}
+
+func (tc *tarContent) Close() error {
+	return tc.f.Close()
+}
+
+// openImageContent opens the image content stored in the image
+// root, either as a staged archive or extracted directory.
+func openImageContent(imageRoot string) (imageContent, error) {
+	archive := filepath.Join(imageRoot, imagesArchive)
+	if _, err := os.Stat(archive); err == nil {
+		return openTarContent(archive)
+	}
+	extracted := filepath.Join(imageRoot, imagesExtracted)
+	if _, err := os.Stat(extracted); err != nil {
+		return nil, fmt.Errorf("no image archive found in %s: %v", imageRoot, err)
+	}
+	return dirContent{root: extracted}, nil
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+type schema2Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// imageRegistry serves the content of an image archive using the
+// registry v2 API. Layers are served uncompressed, their digest
+// is the same as the diff id found in the image configuration.
+type imageRegistry struct {
+	content   imageContent
+	manifests map[string][]byte
+	blobs     map[string]string
+
+	// tags maps repository name and tag to the
+	// manifests served for a registry mirror.
+	tags map[string]string
+}
+
+func newImageRegistry(content imageContent) (*imageRegistry, error) {
+	mf, _, err := content.Open("manifest.json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNoImageManifest
+		}
+		return nil, err
+	}
+	defer closeContent(mf)
+	var saved []struct {
+		Config string
+		Layers []string
+	}
+	if err := json.NewDecoder(mf).Decode(&saved); err != nil {
+		return nil, fmt.Errorf("error decoding manifest.json: %v", err)
+	}
+
+	ir := &imageRegistry{
+		content:   content,
+		manifests: map[string][]byte{},
+		blobs:     map[string]string{},
+		tags:      map[string]string{},
+	}
+	for _, s := range saved {
+		cf, configSize, err := content.Open(s.Config)
+		if err != nil {
+			return nil, fmt.Errorf("error opening config %s: %v", s.Config, err)
+		}
+		var config struct {
+			RootFS struct {
+				DiffIDs []string `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		err = json.NewDecoder(cf).Decode(&config)
+		closeContent(cf)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding config %s: %v", s.Config, err)
+		}
+		if len(config.RootFS.DiffIDs) != len(s.Layers) {
+			return nil, fmt.Errorf("layer count mismatch for %s", s.Config)
+		}
+
+		configDigest := "sha256:" + strings.TrimSuffix(path.Base(s.Config), ".json")
+		ir.blobs[configDigest] = s.Config
+
+		m := schema2Manifest{
+			SchemaVersion: 2,
+			MediaType:     mediaTypeManifest,
+			Config: descriptor{
+				MediaType: mediaTypeConfig,
+				Size:      configSize,
+				Digest:    configDigest,
+			},
+		}
+		for i, layer := range s.Layers {
+			lf, size, err := content.Open(layer)
+			if err != nil {
+				return nil, fmt.Errorf("error opening layer %s: %v", layer, err)
+			}
+			closeContent(lf)
+			ir.blobs[config.RootFS.DiffIDs[i]] = layer
+			m.Layers = append(m.Layers, descriptor{
+				MediaType: mediaTypeLayer,
+				Size:      size,
+				Digest:    config.RootFS.DiffIDs[i],
+			})
+		}
+
+		b, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		ir.manifests[transferTag(configDigest)] = b
+	}
+
+	return ir, nil
+}
+
+// addMirrorTags adds the tags from the tag map to the registry
+// so they can be pulled using the registry as a mirror. Only
+// tags for the default registry may be served by a mirror.
+func (ir *imageRegistry) addMirrorTags(m tagMap) error {
+	for imageID, tags := range m {
+		manifest := transferTag(imageID)
+		if _, ok := ir.manifests[manifest]; !ok {
+			return fmt.Errorf("image %s not found in archive", imageID)
+		}
+		for _, t := range tags {
+			name, ok := mirrorName(t)
+			if !ok {
+				logrus.Debugf("Skipping mirror for %s, not on default registry", t)
+				continue
+			}
+			ir.tags[name] = manifest
+		}
+	}
+	return nil
+}
+
+// mirrorName returns the name and tag as requested from a mirror
+// of the default registry, official images are expanded to include
+// the "library" namespace.
+func mirrorName(t string) (string, bool) {
+	i := strings.Index(t, "/")
+	if i < 0 {
+		return "library/" + t, true
+	}
+	if host := t[:i]; strings.ContainsAny(host, ".:") || host == "localhost" {
+		return "", false
+	}
+	return t, true
+}
+
+// transferTag returns the tag used for transferring an image
+func transferTag(imageID string) string {
+	return strings.TrimPrefix(imageID, "sha256:")
+}
+
+func (ir *imageRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if p == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if i := strings.LastIndex(p, "/manifests/"); i > 0 {
+		name, ref := p[:i], p[i+len("/manifests/"):]
+		if name != transferRepository {
+			ref = ir.tags[name+":"+ref]
+		}
+		b, ok := ir.manifests[ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", mediaTypeManifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(b).String())
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+		return
+	}
+	if i := strings.LastIndex(p, "/blobs/"); i > 0 {
+		dgst := p[i+len("/blobs/"):]
+		name, ok := ir.blobs[dgst]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		rs, _, err := ir.content.Open(name)
+		if err != nil {
+			logrus.Errorf("Error opening blob %s: %v", name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer closeContent(rs)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", dgst)
+		http.ServeContent(w, r, "", time.Time{}, rs)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// serveImageRegistry starts serving the registry on a local port
+// returning the address and a function to stop the server.
+func serveImageRegistry(ir *imageRegistry) (string, func() error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	go func() {
+		if err := http.Serve(l, ir); err != nil {
+			logrus.Debugf("Image registry stopped: %v", err)
+		}
+	}()
+	return l.Addr().String(), l.Close, nil
+}
+
+// transferImages transfers the given images from the image root into
+// the daemon by pulling from a registry serving the image content.
+// The daemon skips layers it already has a registry digest for, such
+// as layers it pulled from this registry before. Layers only loaded
+// with docker load have no such mapping and are transferred again.
+// The references used to pull are returned and should be removed
+// once the images have been tagged.
+func transferImages(client *dockerclient.Client, imageRoot string, imageIDs []string) ([]string, error) {
+	content, err := openImageContent(imageRoot)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	ir, err := newImageRegistry(content)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, stop, err := serveImageRegistry(ir)
+	if err != nil {
+		return nil, fmt.Errorf("error starting image registry: %v", err)
+	}
+	defer stop()
+
+	repo := addr + "/" + transferRepository
+	pulled := make([]string, 0, len(imageIDs))
+	for _, imageID := range imageIDs {
+		tag := transferTag(imageID)
+		if _, ok := ir.manifests[tag]; !ok {
+			return pulled, fmt.Errorf("image %s not found in archive", imageID)
+		}
+		logrus.Debugf("Transferring image %s from %s", imageID, repo)
+		pullOptions := dockerclient.PullImageOptions{
+			Repository:   repo,
+			Tag:          tag,
+			OutputStream: ioutil.Discard,
+		}
+		if err := client.PullImage(pullOptions, dockerclient.AuthConfiguration{}); err != nil {
+			return pulled, fmt.Errorf("error pulling %s: %v", imageID, err)
+		}
+		pulled = append(pulled, repo+":"+tag)
+	}
+
+	return pulled, nil
+}
+
+// StartRegistryMirror starts a registry mirror serving the images
+// from the image root which are listed in the mirror tag map. The
+// URL of the mirror is returned along with a function to stop it.
+func StartRegistryMirror(imageRoot string) (string, func() error, error) {
+	f, err := os.Open(filepath.Join(imageRoot, mirrorTagMap))
+	if err != nil {
+		return "", nil, fmt.Errorf("error opening mirror tag map: %v", err)
+	}
+	defer f.Close()
+
+	var m tagMap
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return "", nil, fmt.Errorf("error decoding mirror tag map: %v", err)
+	}
+
+	content, err := openImageContent(imageRoot)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ir, err := newImageRegistry(content)
+	if err != nil {
+		content.Close()
+		return "", nil, err
+	}
+	if err := ir.addMirrorTags(m); err != nil {
+		content.Close()
+		return "", nil, err
+	}
+
+	addr, stop, err := serveImageRegistry(ir)
+	if err != nil {
+		content.Close()
+		return "", nil, fmt.Errorf("error starting registry mirror: %v", err)
+	}
+	logrus.Debugf("Serving registry mirror at %s", addr)
+
+	closer := func() error {
+		if err := stop(); err != nil {
+			logrus.Errorf("Error stopping registry mirror: %v", err)
+		}
+		return content.Close()
+	}
+
+	return "http://" + addr, closer, nil
+}
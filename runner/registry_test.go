@@ -0,0 +1,113 @@
+package runner
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestImageRegistryFromArchive(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-registry-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	layer := []byte("layer content which is not really a tar")
+	diffID := digest.FromBytes(layer)
+	config, err := json.Marshal(map[string]interface{}{
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{diffID.String()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest := digest.FromBytes(config)
+	manifest, err := json.Marshal([]map[string]interface{}{
+		{
+			"Config": configDigest.Hex() + ".json",
+			"Layers": []string{"abcd/layer.tar"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(td, imagesArchive)
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"abcd/layer.tar", layer},
+		{configDigest.Hex() + ".json", config},
+		{"manifest.json", manifest},
+	}
+	for _, file := range files {
+		hdr := &tar.Header{
+			Name:     file.name,
+			Mode:     0644,
+			Size:     int64(len(file.content)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(file.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	content, err := openImageContent(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+
+	ir, err := newImageRegistry(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, ok := ir.manifests[transferTag(configDigest.String())]
+	if !ok {
+		t.Fatalf("missing manifest for %s", configDigest)
+	}
+	var m schema2Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Config.Digest != configDigest.String() || m.Config.Size != int64(len(config)) {
+		t.Fatalf("unexpected config descriptor %#v", m.Config)
+	}
+	if len(m.Layers) != 1 || m.Layers[0].Digest != diffID.String() || m.Layers[0].Size != int64(len(layer)) {
+		t.Fatalf("unexpected layers %#v", m.Layers)
+	}
+
+	rs, _, err := content.Open(ir.blobs[diffID.String()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := ioutil.ReadAll(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(served) != diffID {
+		t.Fatalf("served layer does not match, got %q", served)
+	}
+}
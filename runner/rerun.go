@@ -0,0 +1,259 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bugsnag/osext"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/golem/versionutil"
+)
+
+// configurationFile is the name of the file in each run
+// directory holding the resolved configuration of the run.
+const configurationFile = "config.json"
+
+// saveConfiguration writes the resolved configuration of a
+// run to its run directory so the run may be repeated.
+func (h *History) saveConfiguration(config runnerConfiguration) error {
+	dir := filepath.Join(h.root, config.RunID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating run directory: %v", err)
+	}
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding run configuration: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, configurationFile), b, 0644); err != nil {
+		return fmt.Errorf("error writing run configuration: %v", err)
+	}
+	return nil
+}
+
+// configuration reads the resolved configuration of a run
+func (h *History) configuration(id string) (runnerConfiguration, error) {
+	f, err := os.Open(filepath.Join(h.root, id, configurationFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return runnerConfiguration{}, fmt.Errorf("no configuration stored for run %s", id)
+		}
+		return runnerConfiguration{}, err
+	}
+	defer f.Close()
+	var config runnerConfiguration
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return runnerConfiguration{}, fmt.Errorf("error decoding run configuration: %v", err)
+	}
+	return config, nil
+}
+
+// CreateRerunner creates a runner repeating the failed instances of
+// a previous run using the configuration stored for the run. Instances
+// with failed tests only run the failed tests of the stage they failed
+// in, instances which failed without a failed test are run in full.
+// Flags which are not stored with the run, such as keeping failed
+// instances, are taken from the configuration manager. Selecting
+// tests is not supported since the failed tests are the selection.
+func (c *ConfigurationManager) CreateRerunner(history *History, run string, loadDockerVersion versionutil.Version, cache CacheConfiguration, output OutputConfiguration) (TestRunner, error) {
+	if !c.selection.empty() {
+		return nil, errors.New("test selection flags cannot be used when rerunning failed tests")
+	}
+	record, err := history.Get(run)
+	if err != nil {
+		return nil, err
+	}
+	config, err := history.configuration(record.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failed tests of each instance by upgrade stage
+	failed := map[string]map[string][]string{}
+	for _, instance := range record.Instances {
+		if instance.Phase == PhasePassed {
+			continue
+		}
+		tests := map[string][]string{}
+		for _, result := range instance.Results {
+			if result.Status == TestFailed {
+				tests[result.Upgrade] = append(tests[result.Upgrade], result.Name)
+			}
+		}
+		failed[instance.Name] = tests
+	}
+	if len(failed) == 0 {
+		return nil, fmt.Errorf("no failed instances in run %s", record.ID)
+	}
+
+	var suites []SuiteConfiguration
+	for _, suite := range config.Suites {
+		var instances []InstanceConfiguration
+		for _, instance := range suite.Instances {
+			tests, ok := failed[instance.Name]
+			if !ok {
+				continue
+			}
+			if count := failedCount(tests); count > 0 {
+				logrus.Infof("Rerunning %d failed tests of %s", count, instance.Name)
+				instance.RunConfiguration = filterFailedTests(instance.RunConfiguration, tests)
+			} else {
+				logrus.Infof("Rerunning %s", instance.Name)
+			}
+			instance.BaseImage.DockerLoadVersion = loadDockerVersion
+			instance.BaseImage.StreamImages = c.streamImages
+			instances = append(instances, instance)
+		}
+		if len(instances) > 0 {
+			suite.Instances = instances
+			suites = append(suites, suite)
+		}
+	}
+	config.Suites = suites
+
+	config.RunID, err = newRunID()
+	if err != nil {
+		return nil, fmt.Errorf("error generating run id: %s", err)
+	}
+	config.RerunOf = record.ID
+	config.KeepOnFailure = c.keepOnFailure
+	config.Debug = c.debug
+	config.MountSuite = c.mountSuite
+	config.CleanDockerGraph = c.cleanGraph
+	config.ExecutablePath, err = osext.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("error getting path to executable: %s", err)
+	}
+
+	return newRunner(config, cache, output), nil
+}
+
+func failedCount(tests map[string][]string) int {
+	var count int
+	for _, names := range tests {
+		count += len(names)
+	}
+	return count
+}
+
+type baseImageJSON struct {
+	Base               string                         `json:"base"`
+	ExtraImages        []string                       `json:"extraimages,omitempty"`
+	CustomImages       []CustomImage                  `json:"customimages,omitempty"`
+	MirrorImages       []string                       `json:"mirrorimages,omitempty"`
+	StreamImages       bool                           `json:"streamimages,omitempty"`
+	DockerLoadVersion  versionutil.Version            `json:"dockerloadversion"`
+	DockerVersion      versionutil.Version            `json:"dockerversion"`
+	DaemonVersions     map[string]versionutil.Version `json:"daemonversions,omitempty"`
+	UpgradeFromVersion versionutil.Version            `json:"upgradefromversion"`
+}
+
+// MarshalJSON encodes the base image configuration
+// with the image references as strings
+func (conf BaseImageConfiguration) MarshalJSON() ([]byte, error) {
+	v := baseImageJSON{
+		CustomImages:       conf.CustomImages,
+		StreamImages:       conf.StreamImages,
+		DockerLoadVersion:  conf.DockerLoadVersion,
+		DockerVersion:      conf.DockerVersion,
+		DaemonVersions:     conf.DaemonVersions,
+		UpgradeFromVersion: conf.UpgradeFromVersion,
+	}
+	if conf.Base != nil {
+		v.Base = conf.Base.String()
+	}
+	for _, image := range conf.ExtraImages {
+		v.ExtraImages = append(v.ExtraImages, image.String())
+	}
+	for _, image := range conf.MirrorImages {
+		v.MirrorImages = append(v.MirrorImages, image.String())
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes a base image configuration
+// encoded with MarshalJSON
+func (conf *BaseImageConfiguration) UnmarshalJSON(b []byte) error {
+	var v baseImageJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*conf = BaseImageConfiguration{
+		CustomImages:       v.CustomImages,
+		StreamImages:       v.StreamImages,
+		DockerLoadVersion:  v.DockerLoadVersion,
+		DockerVersion:      v.DockerVersion,
+		DaemonVersions:     v.DaemonVersions,
+		UpgradeFromVersion: v.UpgradeFromVersion,
+	}
+	if v.Base != "" {
+		base, err := reference.ParseNamed(v.Base)
+		if err != nil {
+			return fmt.Errorf("invalid base image %q: %v", v.Base, err)
+		}
+		conf.Base = base
+	}
+	var err error
+	if conf.ExtraImages, err = parseTaggedImages(v.ExtraImages); err != nil {
+		return err
+	}
+	if conf.MirrorImages, err = parseTaggedImages(v.MirrorImages); err != nil {
+		return err
+	}
+	return nil
+}
+
+type customImageJSON struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// MarshalJSON encodes the custom image with
+// the target reference as a string
+func (ci CustomImage) MarshalJSON() ([]byte, error) {
+	v := customImageJSON{
+		Source: ci.Source,
+	}
+	if ci.Target != nil {
+		v.Target = ci.Target.String()
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes a custom image
+// encoded with MarshalJSON
+func (ci *CustomImage) UnmarshalJSON(b []byte) error {
+	var v customImageJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	targets, err := parseTaggedImages([]string{v.Target})
+	if err != nil {
+		return err
+	}
+	*ci = CustomImage{
+		Source: v.Source,
+		Target: targets[0],
+	}
+	return nil
+}
+
+func parseTaggedImages(images []string) ([]reference.NamedTagged, error) {
+	var tagged []reference.NamedTagged
+	for _, image := range images {
+		ref, err := reference.Parse(image)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image %q: %v", image, err)
+		}
+		named, ok := ref.(reference.NamedTagged)
+		if !ok {
+			return nil, fmt.Errorf("image reference must have name and tag: %s", image)
+		}
+		tagged = append(tagged, named)
+	}
+	return tagged, nil
+}
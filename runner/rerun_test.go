@@ -0,0 +1,99 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/golem/versionutil"
+)
+
+func TestRerunFailed(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-rerun-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	tests := []TestScript{{Script: Script{Command: []string{"bats", "-t", "."}}, Format: "tap"}}
+	instance := func(name string) InstanceConfiguration {
+		return InstanceConfiguration{
+			Name: name,
+			BaseImage: BaseImageConfiguration{
+				Base:          assertTagged("dmcgowan/golem:latest"),
+				ExtraImages:   []reference.NamedTagged{assertTagged("busybox:latest")},
+				CustomImages:  []CustomImage{{Source: "registry:local", Target: assertTagged("registry:2")}},
+				DockerVersion: versionutil.StaticVersion(1, 10, 0),
+			},
+			RunConfiguration: RunConfiguration{TestRunner: tests},
+		}
+	}
+	config := runnerConfiguration{
+		RunID: "20160101-000000-aaaa",
+		Suites: []SuiteConfiguration{
+			{Name: "registry", Instances: []InstanceConfiguration{instance("registry-1"), instance("registry-2"), instance("registry-3")}},
+		},
+	}
+	h := NewHistory(td)
+	if err := h.saveConfiguration(config); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := h.configuration(config.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored.Suites, config.Suites) {
+		t.Fatalf("stored configuration differs:\n%#v\n%#v", stored.Suites, config.Suites)
+	}
+
+	record := RunRecord{
+		ID: config.RunID,
+		Instances: []InstanceRecord{
+			{InstanceStatus: InstanceStatus{Name: "registry-1", Phase: PhasePassed}},
+			{InstanceStatus: InstanceStatus{Name: "registry-2", Phase: PhaseFailed, Results: []TestResult{
+				{Name: "push", Status: TestPassed},
+				{Name: "pull (v2)", Status: TestFailed},
+			}}},
+			{InstanceStatus: InstanceStatus{Name: "registry-3", Phase: PhaseFailed}},
+		},
+	}
+	if err := h.Save(record); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := &ConfigurationManager{selection: testSelection{run: "push"}}
+	if _, err := cm.CreateRerunner(h, LatestRun, versionutil.StaticVersion(1, 10, 1), CacheConfiguration{}, OutputConfiguration{}); err == nil {
+		t.Fatalf("expected error rerunning with a test selection")
+	}
+
+	cm = &ConfigurationManager{keepOnFailure: true, mountSuite: true, streamImages: true}
+	tr, err := cm.CreateRerunner(h, LatestRun, versionutil.StaticVersion(1, 10, 1), CacheConfiguration{}, OutputConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rerun := tr.(*Runner).config
+	if rerun.RerunOf != config.RunID || rerun.RunID == config.RunID {
+		t.Errorf("unexpected run ids %s, %s", rerun.RunID, rerun.RerunOf)
+	}
+	if !rerun.KeepOnFailure {
+		t.Errorf("rerun does not keep failed instances with -keep-on-failure")
+	}
+	if !rerun.MountSuite {
+		t.Errorf("rerun does not mount suites with -mount-suite")
+	}
+	instances := rerun.Suites[0].Instances
+	if len(instances) != 2 || instances[0].Name != "registry-2" || instances[1].Name != "registry-3" {
+		t.Fatalf("unexpected instances %#v", instances)
+	}
+	if !instances[0].BaseImage.StreamImages {
+		t.Errorf("rerun does not stream images with -stream-images")
+	}
+	if filter := instances[0].TestRunner[0].Filter; filter != `^(pull \(v2\))$` {
+		t.Errorf("unexpected filter %q", filter)
+	}
+	if filter := instances[1].TestRunner[0].Filter; filter != "" {
+		t.Errorf("unexpected filter %q for failed instance without failed tests", filter)
+	}
+}
@@ -5,12 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/digest"
@@ -30,8 +33,27 @@ type BaseImageConfiguration struct {
 	ExtraImages  []reference.NamedTagged
 	CustomImages []CustomImage
 
+	// MirrorImages are included in the base image but only
+	// served through the registry mirror, they are not
+	// loaded into the daemon before the test.
+	MirrorImages []reference.NamedTagged
+
+	// StreamImages streams the exported images directly
+	// into the base image rather than staging them in
+	// the build context on disk.
+	StreamImages bool
+
 	DockerLoadVersion versionutil.Version
 	DockerVersion     versionutil.Version
+
+	// DaemonVersions are the docker versions for named
+	// daemons, installed alongside the docker binary
+	DaemonVersions map[string]versionutil.Version
+
+	// UpgradeFromVersion is the docker version to upgrade
+	// from for upgrade tests, if empty no upgrade version
+	// is installed.
+	UpgradeFromVersion versionutil.Version
 }
 
 // Script is the configuration for running a command
@@ -46,6 +68,67 @@ type Script struct {
 type TestScript struct {
 	Script
 	Format string `json:"format"`
+
+	// Retries is the number of times to rerun the failed
+	// tests after the command fails. Tests which fail and
+	// then pass on a retry are reported as flaky.
+	Retries int `json:"retries,omitempty"`
+
+	// Filter is a regular expression of the test names to
+	// run, passed to the test command when not empty.
+	Filter string `json:"filter,omitempty"`
+
+	// FilterArg is the argument for passing the filter to
+	// the test command, if empty the argument is known for
+	// bats and go test.
+	FilterArg string `json:"filterarg,omitempty"`
+
+	// Tags are used to select the test scripts to run
+	Tags []string `json:"tags,omitempty"`
+}
+
+// DaemonConfiguration is the configuration for starting
+// a docker daemon inside the test instance container.
+type DaemonConfiguration struct {
+	// Args are extra arguments passed to the daemon
+	Args []string `json:"args"`
+
+	// Env are extra environment variables for the daemon
+	Env []string `json:"env"`
+
+	// ConfigFile is the content of the daemon configuration
+	// file, if empty then no configuration file is used.
+	ConfigFile string `json:"config"`
+}
+
+// NamedDaemonConfiguration is the configuration for an additional
+// named docker daemon run inside the test instance container. Each
+// named daemon has its own socket and graph directory.
+type NamedDaemonConfiguration struct {
+	DaemonConfiguration
+
+	Name string `json:"name"`
+
+	// Binary is the path to the docker binary used to
+	// run the daemon inside the test instance container
+	Binary string `json:"binary"`
+
+	// StorageDriver is the storage driver for the daemon,
+	// if empty the default storage driver is used.
+	StorageDriver string `json:"storagedriver"`
+}
+
+// UpgradeConfiguration is the configuration for testing an
+// in-place upgrade of the docker daemon. The before tests are
+// run against a daemon using the binary, then the test daemon
+// is started on the same graph and the after tests are run.
+type UpgradeConfiguration struct {
+	// Binary is the path to the docker binary used
+	// before the upgrade inside the test container
+	Binary string `json:"binary"`
+
+	Before []TestScript `json:"before"`
+	After  []TestScript `json:"after"`
 }
 
 // RunConfiguration is the all the command
@@ -54,6 +137,56 @@ type TestScript struct {
 type RunConfiguration struct {
 	Setup      []Script     `json:"setup"`
 	TestRunner []TestScript `json:"runner"`
+
+	// SuiteEnv and Env are the environment for the suite and
+	// the instance, scripts inherit the container environment
+	// merged with the suite, instance, and script environment.
+	SuiteEnv []string `json:"suiteenv"`
+	Env      []string `json:"env"`
+
+	// PostTest are scripts run after the tests whether
+	// or not the tests passed
+	PostTest []Script `json:"posttest"`
+
+	// OnFailure are scripts run after the tests only
+	// when setup or the tests failed
+	OnFailure []Script `json:"onfailure"`
+
+	// Daemon is the configuration for the daemon used by tests
+	Daemon DaemonConfiguration `json:"daemon"`
+
+	// LoadDaemon is the configuration for the daemon used
+	// for loading images before the test daemon is started
+	LoadDaemon DaemonConfiguration `json:"loaddaemon"`
+
+	// Daemons are additional named daemons started
+	// along with the daemon used by tests
+	Daemons []NamedDaemonConfiguration `json:"daemons"`
+
+	// Upgrade is the configuration for an upgrade test, if
+	// nil then no upgrade is done before running tests.
+	Upgrade *UpgradeConfiguration `json:"upgrade,omitempty"`
+
+	// Ready are the readiness checks for compose services,
+	// tests are not run until all checks pass.
+	Ready []ReadyCheck `json:"ready"`
+
+	// ReadyTimeout is how long to wait for readiness checks,
+	// if zero a default is used.
+	ReadyTimeout time.Duration `json:"readytimeout"`
+
+	// Compose is the configuration for running docker compose,
+	// if nil the default compose file is used when it exists.
+	Compose *ComposeConfiguration `json:"compose,omitempty"`
+
+	// Shards is the configuration for splitting the tests
+	// across multiple containers, if nil the tests are run
+	// in a single container.
+	Shards *ShardConfiguration `json:"shards,omitempty"`
+
+	// SecretEnv are the names of the environment variables
+	// holding secrets, the values are redacted from logs.
+	SecretEnv []string `json:"secretenv,omitempty"`
 }
 
 // InstanceConfiguration is the configuration
@@ -63,6 +196,10 @@ type InstanceConfiguration struct {
 
 	Name      string
 	BaseImage BaseImageConfiguration
+
+	// Secrets are read on the host when the instance
+	// is run and passed to the instance container.
+	Secrets []SecretConfiguration
 }
 
 // SuiteConfiguration is the configuration for
@@ -76,14 +213,25 @@ type SuiteConfiguration struct {
 
 	DockerInDocker bool
 
+	// Tags are used to select the suites to run
+	Tags []string
+
 	Instances []InstanceConfiguration
 }
 
+// BuildManifest is the result of building the test instance
+// images for a run. It maps each instance name to the image
+// which should be used to run that instance.
+type BuildManifest struct {
+	RunID     string
+	Instances map[string]string
+}
+
 // TestRunner defines an interface for building
 // and running a test.
 type TestRunner interface {
-	Build(DockerClient) error
-	Run(DockerClient) error
+	Build(DockerClient) (BuildManifest, error)
+	Run(DockerClient, BuildManifest) error
 }
 
 // runnerConfiguration is the configuration for
@@ -94,6 +242,10 @@ type TestRunner interface {
 type runnerConfiguration struct {
 	Suites []SuiteConfiguration
 
+	// RunID uniquely identifies this run and is used
+	// to tag the instance images built for the run.
+	RunID string
+
 	ExecutableName string
 	ExecutablePath string
 
@@ -103,6 +255,27 @@ type runnerConfiguration struct {
 	// local volumes will be used and suite images
 	// will first be pushed before running.
 	Swarm bool
+
+	// CleanDockerGraph whether to fully clean the cached
+	// docker graph in each instance before running.
+	CleanDockerGraph bool
+
+	// RerunOf is the id of the run whose failed tests
+	// are being run again.
+	RerunOf string
+
+	// KeepOnFailure whether to leave instance containers
+	// running without tearing down when the tests fail.
+	KeepOnFailure bool `json:"-"`
+
+	// Debug whether to open a debug shell in each instance
+	// before the tests are run.
+	Debug bool `json:"-"`
+
+	// MountSuite whether to bind mount the suite directories
+	// in the instance containers instead of copying them
+	// into the instance images.
+	MountSuite bool `json:"-"`
 }
 
 // Runner represents a golem run session including
@@ -111,19 +284,140 @@ type runnerConfiguration struct {
 type Runner struct {
 	config runnerConfiguration
 	cache  CacheConfiguration
+	output OutputConfiguration
+
+	// started is when the build of the run started
+	started time.Time
+
+	// debugLock allows one debug shell at a time
+	debugLock sync.Mutex
 }
 
-// newRunner creates a new runner from a runner
-// and cache configuration.
-func newRunner(config runnerConfiguration, cache CacheConfiguration) TestRunner {
+// OutputConfiguration is the configuration for where the
+// logs and status of a run are collected.
+type OutputConfiguration struct {
+	// RunsDir is the directory the logs of each run are
+	// collected into, each run uses a directory named by the
+	// run id with a directory for each instance. If empty,
+	// logs are kept in a volume of the instance container.
+	RunsDir string
+
+	// Monitor receives the status of each instance, if
+	// nil no status is tracked.
+	Monitor *Monitor
+
+	// History records the run when it finishes, if nil
+	// the run is not recorded.
+	History *History
+}
+
+// newRunner creates a new runner from a runner,
+// cache, and output configuration.
+func newRunner(config runnerConfiguration, cache CacheConfiguration, output OutputConfiguration) TestRunner {
 	return &Runner{
 		config: config,
 		cache:  cache,
+		output: output,
 	}
 }
 
-func (r *Runner) imageName(name string) string {
-	imageName := "golem-" + name + ":latest"
+// logDir returns the host directory the logs for
+// the instance are collected into.
+func (r *Runner) logDir(instanceName string) string {
+	if r.output.RunsDir == "" {
+		return ""
+	}
+	return filepath.Join(r.output.RunsDir, r.config.RunID, instanceName)
+}
+
+// events returns the event reporter for the instance
+func (r *Runner) events(instanceName string) EventReporter {
+	if r.output.Monitor == nil {
+		return nopReporter{}
+	}
+	return instanceReporter{
+		instance: instanceName,
+		reporter: r.output.Monitor,
+	}
+}
+
+// debug opens a debug shell in the instance container held
+// before its tests, continuing the tests when the shell exits.
+func (r *Runner) debug(client DockerClient, containerID string) error {
+	r.debugLock.Lock()
+	defer r.debugLock.Unlock()
+	logrus.Infof("Opening debug shell in %s, exit the shell to run the tests", containerID)
+	shellErr := DebugShell(client, containerID)
+	if err := ContinueInstance(client, containerID); err != nil {
+		return err
+	}
+	return shellErr
+}
+
+// saveHistory records the run in the history with the
+// status of each instance and the error ending the run.
+func (r *Runner) saveHistory(runErr error) {
+	if r.output.History == nil {
+		return
+	}
+	dgst, err := configDigest(r.config, r.cache.BuildCache)
+	if err != nil {
+		logrus.Errorf("Error computing configuration digest: %v", err)
+	}
+	record := RunRecord{
+		ID:           r.config.RunID,
+		Started:      r.started,
+		Finished:     time.Now(),
+		ConfigDigest: dgst,
+		RerunOf:      r.config.RerunOf,
+	}
+	if runErr != nil {
+		record.Error = runErr.Error()
+	}
+	for _, suite := range r.config.Suites {
+		for _, instance := range suite.Instances {
+			status := InstanceStatus{
+				Name:  instance.Name,
+				Suite: suite.Name,
+			}
+			if r.output.Monitor != nil {
+				shards := r.shards(instance)
+				statuses := make([]InstanceStatus, 0, len(shards))
+				for _, sh := range shards {
+					if s, ok := r.output.Monitor.Instance(sh.name); ok {
+						statuses = append(statuses, s)
+					}
+				}
+				if len(shards) > 1 {
+					status = mergeShards(instance.Name, suite.Name, r.logDir(instance.Name), statuses)
+				} else if len(statuses) == 1 {
+					status = statuses[0]
+				}
+			}
+			record.DockerLoadVersion = instance.BaseImage.DockerLoadVersion.String()
+			record.Instances = append(record.Instances, InstanceRecord{
+				InstanceStatus:     status,
+				LogDir:             r.logDir(instance.Name),
+				DockerVersion:      instance.BaseImage.DockerVersion.String(),
+				DaemonVersions:     versionStrings(instance.BaseImage),
+				UpgradeFromVersion: instance.BaseImage.UpgradeFromVersion.String(),
+				CustomImages:       imageSources(instance.BaseImage.CustomImages),
+			})
+		}
+	}
+	if err := r.output.History.Save(record); err != nil {
+		logrus.Errorf("Error saving run history: %v", err)
+	}
+}
+
+// imageLabel is the container label holding the name
+// of the instance image the container was created from
+const imageLabel = "golem.image"
+
+// imageName returns the image name used to tag the image
+// for the given instance in this run.
+func (r *Runner) imageName(instanceName string) string {
+	imageName := "golem-" + instanceName + ":" + r.config.RunID
 	if r.config.ImageNamespace != "" {
 		imageName = path.Join(r.config.ImageNamespace, imageName)
 	}
@@ -132,26 +426,66 @@ func (r *Runner) imageName(name string) string {
 
 // Build builds all suite instance image configured for
 // the runner. The result of build will be locally built
-// and tagged images ready to push or run directory.
-func (r *Runner) Build(client DockerClient) error {
+// and tagged images ready to push or run directory. The
+// returned manifest maps each instance to its built image.
+func (r *Runner) Build(client DockerClient) (manifest BuildManifest, err error) {
+	r.started = time.Now()
+	defer func() {
+		if err != nil {
+			r.saveHistory(err)
+		}
+	}()
+	manifest = BuildManifest{
+		RunID:     r.config.RunID,
+		Instances: map[string]string{},
+	}
+	if r.output.History != nil {
+		if err := r.output.History.saveConfiguration(r.config); err != nil {
+			return BuildManifest{}, err
+		}
+	}
 	for _, suite := range r.config.Suites {
 		for _, instance := range suite.Instances {
+			if _, ok := manifest.Instances[instance.Name]; ok {
+				return BuildManifest{}, fmt.Errorf("duplicate instance name %s", instance.Name)
+			}
+
+			// The image is built once for all shards
+			var events eventReporters
+			for _, sh := range r.shards(instance) {
+				if r.output.Monitor != nil {
+					if sh.name == instance.Name {
+						r.output.Monitor.addInstance(suite.Name, instance.Name, sh.logDir)
+					} else {
+						r.output.Monitor.addShard(suite.Name, instance.Name, sh.index, sh.name, sh.logDir)
+					}
+				}
+				events = append(events, r.events(sh.name))
+			}
+			events.Report(Event{Type: EventPhaseStarted, Phase: PhaseBuilding})
+			start := time.Now()
+			buildFailed := func(err error) {
+				events.Report(Event{Type: EventPhaseFinished, Phase: PhaseBuilding, Duration: time.Since(start), Error: err.Error()})
+				events.Report(Event{Type: EventInstanceFinished, Phase: PhaseFailed, Error: err.Error()})
+			}
+
 			baseImage, err := BuildBaseImage(client, instance.BaseImage, r.cache)
 			if err != nil {
-				return fmt.Errorf("failure building base image: %v", err)
+				buildFailed(err)
+				return BuildManifest{}, fmt.Errorf("failure building base image: %v", err)
 			}
 
 			// Create temp build directory
 			td, err := ioutil.TempDir("", "golem-")
 			if err != nil {
-				return fmt.Errorf("unable to create tempdir: %v", err)
+				return BuildManifest{}, fmt.Errorf("unable to create tempdir: %v", err)
 			}
 			defer os.RemoveAll(td)
 
 			// Create Dockerfile in tempDir
 			df, err := os.OpenFile(filepath.Join(td, "Dockerfile"), os.O_CREATE|os.O_WRONLY, 0644)
 			if err != nil {
-				return fmt.Errorf("error creating dockerfile: %v", err)
+				return BuildManifest{}, fmt.Errorf("error creating dockerfile: %v", err)
 			}
 			defer df.Close()
 
@@ -161,150 +495,400 @@ func (r *Runner) Build(client DockerClient) error {
 			buildutil.CopyFile(r.config.ExecutablePath, filepath.Join(td, r.config.ExecutableName), 0755)
 			fmt.Fprintf(df, "COPY ./%s /usr/bin/%s\n", r.config.ExecutableName, r.config.ExecutableName)
 
-			logrus.Debugf("Copying %s to %s", suite.Path, filepath.Join(td, "runner"))
-			if err := shutil.CopyTree(suite.Path, filepath.Join(td, "runner"), nil); err != nil {
-				return fmt.Errorf("error copying test directory: %v", err)
-			}
+			logrus.Debugf("Run configuration: %#v", instance.RunConfiguration)
 
-			fmt.Fprintln(df, "COPY ./runner/ /runner")
+			// The suite and run configuration are mounted
+			// when the container is started instead
+			if !r.config.MountSuite {
+				logrus.Debugf("Copying %s to %s", suite.Path, filepath.Join(td, "runner"))
+				if err := shutil.CopyTree(suite.Path, filepath.Join(td, "runner"), nil); err != nil {
+					return BuildManifest{}, fmt.Errorf("error copying test directory: %v", err)
+				}
 
-			logrus.Debugf("Run configuration: %#v", instance.RunConfiguration)
+				fmt.Fprintln(df, "COPY ./runner/ /runner")
 
-			instanceF, err := os.Create(filepath.Join(td, "instance.json"))
-			if err != nil {
-				return fmt.Errorf("error creating instance json file: %s", err)
-			}
-			if err := json.NewEncoder(instanceF).Encode(instance.RunConfiguration); err != nil {
+				instanceF, err := os.Create(filepath.Join(td, "instance.json"))
+				if err != nil {
+					return BuildManifest{}, fmt.Errorf("error creating instance json file: %s", err)
+				}
+				if err := json.NewEncoder(instanceF).Encode(instance.RunConfiguration); err != nil {
+					instanceF.Close()
+					return BuildManifest{}, fmt.Errorf("error encoding configuration: %s", err)
+				}
 				instanceF.Close()
-				return fmt.Errorf("error encoding configuration: %s", err)
-			}
-			instanceF.Close()
 
-			fmt.Fprintln(df, "COPY ./instance.json /instance.json")
+				fmt.Fprintln(df, "COPY ./instance.json /instance.json")
+			}
 
 			if err := df.Close(); err != nil {
-				return fmt.Errorf("error closing dockerfile: %s", err)
+				return BuildManifest{}, fmt.Errorf("error closing dockerfile: %s", err)
 			}
 
-			builder, err := client.NewBuilder(td, "", r.imageName(instance.Name))
+			imageName := r.imageName(instance.Name)
+			builder, err := client.NewBuilder(td, "", imageName)
 			if err != nil {
-				return fmt.Errorf("failed to create builder: %s", err)
+				return BuildManifest{}, fmt.Errorf("failed to create builder: %s", err)
 			}
 
 			if err := builder.Run(); err != nil {
-				return fmt.Errorf("build error: %s", err)
+				buildFailed(err)
+				return BuildManifest{}, fmt.Errorf("build error: %s", err)
 			}
+			events.Report(Event{Type: EventPhaseFinished, Phase: PhaseBuilding, Duration: time.Since(start)})
+
+			logrus.Debugf("Built instance %s as %s (%s)", instance.Name, imageName, builder.ImageID())
+			manifest.Instances[instance.Name] = builder.ImageID()
 		}
 	}
-	return nil
+	return manifest, nil
 }
 
 // Run starts the test instance containers as well as any
 // containers which will manage the tests and waits for
-// the results.
-func (r *Runner) Run(client DockerClient) error {
-	// TODO: Run in parallel (use libcompose?)
+// the results. The manifest must be the result of a build
+// for this runner. The containers for the shards of an
+// instance are run in parallel.
+func (r *Runner) Run(client DockerClient, manifest BuildManifest) (err error) {
+	defer func() {
+		r.saveHistory(err)
+	}()
 	// TODO: validate namespace when in swarm mode
 	for _, suite := range r.config.Suites {
 		for _, instance := range suite.Instances {
-			// TODO: Add configuration for nocache
-			nocache := false
-			contName := "golem-" + instance.Name
+			image, ok := manifest.Instances[instance.Name]
+			if !ok {
+				return fmt.Errorf("no image built for instance %s", instance.Name)
+			}
 
-			hc := &dockerclient.HostConfig{
-				Privileged: true,
+			shards := r.shards(instance)
+			containers := make([]string, len(shards))
+			for i, sh := range shards {
+				containerID, err := r.startContainer(client, suite, instance, image, sh)
+				if err != nil {
+					// The shards already started are never attached
+					removeContainers(client, containers[:i], r.imageName(instance.Name))
+					return err
+				}
+				containers[i] = containerID
 			}
 
-			args := []string{}
-			if suite.DockerInDocker {
-				args = append(args, "-docker")
+			var wg sync.WaitGroup
+			errs := make([]error, len(shards))
+			for i, sh := range shards {
+				wg.Add(1)
+				go func(i int, sh shard) {
+					defer wg.Done()
+					errs[i] = r.attach(client, containers[i], sh.logDir, r.events(sh.name))
+				}(i, sh)
 			}
-			// TODO: Add argument for instance name
-
-			config := &dockerclient.Config{
-				Image:      r.imageName(suite.Name),
-				Cmd:        append([]string{fmt.Sprintf("/usr/bin/%s", r.config.ExecutableName)}, args...),
-				WorkingDir: "/runner",
-				Volumes: map[string]struct{}{
-					"/var/log/docker": struct{}{},
-				},
-				VolumeDriver: "local",
+			wg.Wait()
+			for _, err := range errs {
+				if err != nil {
+					return err
+				}
 			}
+		}
+	}
+	return nil
+}
 
-			if suite.DockerInDocker {
-				config.Env = append(config.Env, "DOCKER_GRAPHDRIVER="+getGraphDriver())
+// removeContainers stops and removes the containers along with
+// the image tag they were created from, logging errors
+func removeContainers(client DockerClient, containers []string, imageName string) {
+	for _, id := range containers {
+		removeOptions := dockerclient.RemoveContainerOptions{
+			ID:            id,
+			RemoveVolumes: true,
+			Force:         true,
+		}
+		if err := client.RemoveContainer(removeOptions); err != nil {
+			logrus.Errorf("Error removing container %s: %v", id, err)
+		}
+	}
+	removeImageTag(client, imageName)
+}
 
-				// TODO: In swarm mode, do not use a cached volume
-				volumeName := contName + "-graph"
-				cont, err := client.InspectContainer(contName)
-				if err == nil {
-					removeOptions := dockerclient.RemoveContainerOptions{
-						ID:            cont.ID,
-						RemoveVolumes: true,
-					}
-					if err := client.RemoveContainer(removeOptions); err != nil {
-						return fmt.Errorf("error removing existing container %s: %v", contName, err)
-					}
-				}
+// removeImageTag removes the per-run tag of an instance image. The
+// image is kept while another container, such as another shard from
+// the same run, still uses it, the tag is then removed along with
+// that container.
+func removeImageTag(client DockerClient, imageName string) {
+	if err := client.RemoveImage(imageName); err != nil && err != dockerclient.ErrNoSuchImage {
+		logrus.Debugf("Not removing image %s: %v", imageName, err)
+	}
+}
 
-				vol, err := client.InspectVolume(volumeName)
-				if err == nil {
-					if nocache {
-						if err := client.RemoveVolume(vol.Name); err != nil {
-							return fmt.Errorf("error removing volume %s: %v", vol.Name, err)
-						}
-						vol = nil
-					}
-				}
+// startContainer creates and starts the container for
+// a shard of an instance, returning the container id.
+func (r *Runner) startContainer(client DockerClient, suite SuiteConfiguration, instance InstanceConfiguration, image string, sh shard) (string, error) {
+	// TODO: Add configuration for nocache
+	nocache := false
+	contName := "golem-" + sh.name
+	events := r.events(sh.name)
+	events.Report(Event{Type: EventPhaseStarted, Phase: PhaseStarting})
+	start := time.Now()
+
+	hc := &dockerclient.HostConfig{
+		Privileged: true,
+	}
 
-				if vol == nil {
-					createOptions := dockerclient.CreateVolumeOptions{
-						Name:   volumeName,
-						Driver: "local",
-					}
-					vol, err = client.CreateVolume(createOptions)
-					if err != nil {
-						return fmt.Errorf("error creating volume: %v", err)
-					}
-				}
+	args := []string{}
+	if suite.DockerInDocker {
+		args = append(args, "-docker")
+		if r.config.CleanDockerGraph {
+			args = append(args, "-clean")
+		}
+	}
+	if r.config.KeepOnFailure {
+		args = append(args, "-keep-on-failure")
+	}
+	if r.config.Debug {
+		args = append(args, "-debug")
+	}
+	// Secrets are sent to the runner once the container is
+	// started, keeping them out of the container configuration
+	secrets, err := readSecrets(instance.Secrets)
+	if err != nil {
+		return "", err
+	}
+	if len(instance.Secrets) > 0 {
+		args = append(args, "-secrets")
+	}
+	// TODO: Add argument for instance name
+
+	imageName := r.imageName(instance.Name)
+	config := &dockerclient.Config{
+		Image:        image,
+		Cmd:          append([]string{fmt.Sprintf("/usr/bin/%s", r.config.ExecutableName)}, args...),
+		WorkingDir:   "/runner",
+		Volumes:      map[string]struct{}{},
+		VolumeDriver: "local",
+		Env:          sh.env,
+		// The per-run image tag is removed along with the container
+		Labels: map[string]string{imageLabel: imageName},
+	}
+
+	if sh.logDir != "" {
+		if err := os.MkdirAll(sh.logDir, 0755); err != nil {
+			return "", fmt.Errorf("error creating log directory: %v", err)
+		}
+		hc.Binds = append(hc.Binds, fmt.Sprintf("%s:/var/log/docker", sh.logDir))
+	} else {
+		config.Volumes["/var/log/docker"] = struct{}{}
+	}
+
+	// Named daemons each get a fresh graph volume
+	for _, daemon := range instance.RunConfiguration.Daemons {
+		config.Volumes[daemonGraph(daemon.Name)] = struct{}{}
+	}
+
+	if r.config.MountSuite {
+		if err := mountSuite(hc, config, suite, instance.RunConfiguration); err != nil {
+			return "", err
+		}
+	}
 
-				logrus.Debugf("Mounting %s to %s", vol.Mountpoint, "/var/lib/docker")
-				hc.Binds = append(hc.Binds, fmt.Sprintf("%s:/var/lib/docker", vol.Mountpoint))
+	// A container left from a previous run is removed unless it
+	// is still running, such as an instance kept after failing
+	if cont, err := client.InspectContainer(contName); err == nil {
+		if cont.State.Running {
+			return "", fmt.Errorf("container %s from a previous run is still running, it may have been kept with -keep-on-failure, remove it with \"docker rm -f %s\"", contName, contName)
+		}
+		removeOptions := dockerclient.RemoveContainerOptions{
+			ID:            cont.ID,
+			RemoveVolumes: true,
+		}
+		if err := client.RemoveContainer(removeOptions); err != nil {
+			return "", fmt.Errorf("error removing existing container %s: %v", contName, err)
+		}
+		if cont.Config != nil {
+			if previous := cont.Config.Labels[imageLabel]; previous != "" && previous != imageName {
+				removeImageTag(client, previous)
 			}
+		}
+	}
+
+	if suite.DockerInDocker {
+		config.Env = append(config.Env, "DOCKER_GRAPHDRIVER="+getGraphDriver())
 
-			cc := dockerclient.CreateContainerOptions{
-				Name:       contName,
-				Config:     config,
-				HostConfig: hc,
+		// TODO: In swarm mode, do not use a cached volume
+		volumeName := contName + "-graph"
+		vol, err := client.InspectVolume(volumeName)
+		if err == nil {
+			if nocache {
+				if err := client.RemoveVolume(vol.Name); err != nil {
+					return "", fmt.Errorf("error removing volume %s: %v", vol.Name, err)
+				}
+				vol = nil
 			}
+		}
 
-			container, err := client.CreateContainer(cc)
+		if vol == nil {
+			createOptions := dockerclient.CreateVolumeOptions{
+				Name:   volumeName,
+				Driver: "local",
+			}
+			vol, err = client.CreateVolume(createOptions)
 			if err != nil {
-				return fmt.Errorf("error creating container: %s", err)
+				return "", fmt.Errorf("error creating volume: %v", err)
 			}
+		}
+
+		logrus.Debugf("Mounting %s to %s", vol.Mountpoint, "/var/lib/docker")
+		hc.Binds = append(hc.Binds, fmt.Sprintf("%s:/var/lib/docker", vol.Mountpoint))
+	}
+
+	cc := dockerclient.CreateContainerOptions{
+		Name:       contName,
+		Config:     config,
+		HostConfig: hc,
+	}
 
-			if err := client.StartContainer(container.ID, hc); err != nil {
-				return fmt.Errorf("error starting container: %s", err)
+	container, err := client.CreateContainer(cc)
+	if err != nil {
+		return "", fmt.Errorf("error creating container: %s", err)
+	}
+
+	if err := client.StartContainer(container.ID, hc); err != nil {
+		return "", fmt.Errorf("error starting container: %s", err)
+	}
+	if len(instance.Secrets) > 0 {
+		if err := sendSecrets(client, container.ID, config.Cmd[0], secrets); err != nil {
+			if err := client.KillContainer(dockerclient.KillContainerOptions{ID: container.ID}); err != nil {
+				logrus.Errorf("Error killing container %s: %v", contName, err)
 			}
+			return "", err
+		}
+	}
+	events.Report(Event{Type: EventPhaseFinished, Phase: PhaseStarting, Duration: time.Since(start)})
 
-			// TODO: Capture output
-			attachOptions := dockerclient.AttachToContainerOptions{
-				Container:    container.ID,
-				OutputStream: os.Stdout,
-				ErrorStream:  os.Stderr,
-				Logs:         true,
-				Stream:       true,
-				Stdout:       true,
-				Stderr:       true,
+	return container.ID, nil
+}
+
+// attach attaches to the instance container until it exits. When
+// collecting logs, the container output is also written to the log
+// directory and the event stream of the runner is followed.
+func (r *Runner) attach(client DockerClient, containerID, logDir string, events EventReporter) error {
+	// Output is redacted of the secrets read on the host
+	stdout := newRedactingWriter(os.Stdout)
+	stderr := newRedactingWriter(os.Stderr)
+	attachOptions := dockerclient.AttachToContainerOptions{
+		Container:    containerID,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Logs:         true,
+		Stream:       true,
+		Stdout:       true,
+		Stderr:       true,
+	}
+
+	var (
+		stop = make(chan struct{})
+		done = make(chan struct{})
+		held = make(chan Phase, 2)
+	)
+	events = eventReporters{events, EventHandlerFunc(func(event Event) {
+		if event.Type == EventPhaseStarted && (event.Phase == PhaseDebug || event.Phase == PhaseKept) {
+			select {
+			case held <- event.Phase:
+			default:
+			}
+		}
+	})}
+	if logDir != "" {
+		f, err := os.Create(filepath.Join(logDir, instanceOutput))
+		if err != nil {
+			return fmt.Errorf("error creating output file: %v", err)
+		}
+		defer f.Close()
+		stdout = newRedactingWriter(io.MultiWriter(os.Stdout, f))
+		stderr = newRedactingWriter(io.MultiWriter(os.Stderr, f))
+		attachOptions.OutputStream = stdout
+		attachOptions.ErrorStream = stderr
+		events.Report(Event{Type: EventLogFile, LogFile: instanceOutput})
+
+		go func() {
+			followEvents(filepath.Join(logDir, eventsFile), events, stop)
+			close(done)
+		}()
+	} else {
+		close(done)
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+
+	attached := make(chan error, 1)
+	go func() {
+		attached <- client.AttachToContainer(attachOptions)
+	}()
+
+	// The runner holds the instance when debugging before the
+	// tests or when keeping a failed instance
+	var attachErr error
+	for {
+		select {
+		case attachErr = <-attached:
+		case phase := <-held:
+			if phase == PhaseKept {
+				close(stop)
+				<-done
+				// The container output is still being copied, discard
+				// it before the output file is closed
+				stdout.Close()
+				stderr.Close()
+				logrus.Infof("Instance container %s kept running, open a shell with \"golem debug %s\"", containerID, containerID)
+				events.Report(Event{Type: EventInstanceFinished, Phase: PhaseFailed, Error: "tests failed, instance kept running for debugging"})
+				return nil
 			}
-			if err := client.AttachToContainer(attachOptions); err != nil {
-				return fmt.Errorf("Error attaching to container: %v", err)
+			if err := r.debug(client, containerID); err != nil {
+				logrus.Errorf("Error debugging instance: %v", err)
 			}
+			continue
 		}
+		break
+	}
+	close(stop)
+	<-done
+
+	if attachErr != nil {
+		events.Report(Event{Type: EventInstanceFinished, Phase: PhaseFailed, Error: attachErr.Error()})
+		return fmt.Errorf("Error attaching to container: %v", attachErr)
 	}
+
+	cont, err := client.InspectContainer(containerID)
+	if err != nil {
+		return fmt.Errorf("error inspecting container: %v", err)
+	}
+	if cont.State.ExitCode == 0 {
+		events.Report(Event{Type: EventInstanceFinished, Phase: PhasePassed})
+	} else {
+		events.Report(Event{Type: EventInstanceFinished, Phase: PhaseFailed, Error: fmt.Sprintf("instance exited with code %d", cont.State.ExitCode)})
+	}
+
 	return nil
 }
 
+// daemonBinary returns the path of the docker binary
+// installed for the named daemon
+func daemonBinary(name string) string {
+	return "/usr/bin/docker-daemon-" + name
+}
+
+// upgradeBinary is the path of the docker binary installed
+// for the daemon run before an upgrade
+const upgradeBinary = "/usr/bin/docker-upgrade-from"
+
+// upgradeDaemonName is the name of the daemon run before an
+// upgrade, its logs and configuration file use the same names
+// as a named daemon so named daemons may not use it
+const upgradeDaemonName = "upgrade"
+
+// daemonGraph returns the graph directory for the named
+// daemon inside the test instance container
+func daemonGraph(name string) string {
+	return "/var/lib/docker-" + name
+}
+
 func getGraphDriver() string {
 	d := os.Getenv("DOCKER_GRAPHDRIVER")
 	switch d {
@@ -357,21 +941,6 @@ func ensureImage(client DockerClient, image string) (string, error) {
 	return info.ID, nil
 }
 
-func saveImage(client DockerClient, filename, imgID string) error {
-	// TODO: must not exist
-	f, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("error creating image tar file: %v", err)
-	}
-	defer f.Close()
-	logrus.Debugf("Exporting image %s to %s", imgID, filename)
-	ec := dockerclient.ExportImageOptions{
-		Name:         imgID,
-		OutputStream: f,
-	}
-	return client.ExportImage(ec)
-}
-
 func saveTagMap(filename string, tags []tag) error {
 	m := map[string][]string{}
 	for _, t := range tags {
@@ -385,7 +954,7 @@ func saveTagMap(filename string, tags []tag) error {
 	defer mf.Close()
 
 	if err := json.NewEncoder(mf).Encode(m); err != nil {
-		return fmt.Errorf("error encoding tag map: %v")
+		return fmt.Errorf("error encoding tag map: %v", err)
 	}
 
 	return nil
@@ -471,41 +1040,58 @@ const (
 	// hashVersion is used to force build cache
 	// busting when the method to compute the
 	// hash changes
-	hashVersion = "1"
+	hashVersion = "2"
 )
 
 // BuildBaseImage builds a base image using the given configuration
 // and returns an image id for the given image
 func BuildBaseImage(client DockerClient, conf BaseImageConfiguration, c CacheConfiguration) (string, error) {
-	tags := []tag{}
-	images := []string{}
+	sources := make([]string, 0, len(conf.ExtraImages)+len(conf.CustomImages))
+	targets := make([]reference.NamedTagged, 0, len(conf.ExtraImages)+len(conf.CustomImages))
 	for _, ref := range conf.ExtraImages {
-		id, err := ensureImage(client, ref.String())
-		if err != nil {
-			return "", err
-		}
-		tags = append(tags, tag{
-			Tag:   ref,
-			Image: id,
-		})
-		images = append(images, id)
+		sources = append(sources, ref.String())
+		targets = append(targets, ref)
 	}
 	for _, ci := range conf.CustomImages {
-		id, err := ensureImage(client, ci.Source)
-		if err != nil {
-			return "", err
-		}
-		tags = append(tags, tag{
-			Tag:   ci.Target,
-			Image: id,
-		})
+		sources = append(sources, ci.Source)
+		targets = append(targets, ci.Target)
+	}
+	for _, ref := range conf.MirrorImages {
+		sources = append(sources, ref.String())
+		targets = append(targets, ref)
+	}
 
-		images = append(images, id)
+	ids, err := ensureImages(client, sources)
+	if err != nil {
+		return "", err
+	}
+
+	tags := []tag{}
+	mirrorTags := []tag{}
+	images := []string{}
+	imageSet := map[string]struct{}{}
+	for i := range targets {
+		t := tag{
+			Tag:   targets[i],
+			Image: ids[i],
+		}
+		if i < len(conf.ExtraImages)+len(conf.CustomImages) {
+			tags = append(tags, t)
+		} else {
+			mirrorTags = append(mirrorTags, t)
+		}
+		if _, ok := imageSet[ids[i]]; !ok {
+			imageSet[ids[i]] = struct{}{}
+			images = append(images, ids[i])
+		}
 	}
 
 	dgstr := digest.Canonical.New()
 	// Add runner options
 	fmt.Fprintf(dgstr.Hash(), "Version: %s\n", hashVersion)
+	if conf.StreamImages {
+		fmt.Fprintln(dgstr.Hash(), "Stream images")
+	}
 	fmt.Fprintln(dgstr.Hash())
 	fmt.Fprintln(dgstr.Hash())
 
@@ -525,9 +1111,42 @@ func BuildBaseImage(client DockerClient, conf BaseImageConfiguration, c CacheCon
 
 	fmt.Fprintln(dgstr.Hash())
 
+	mirrored := []string{}
+	for _, t := range mirrorTags {
+		mirrored = append(mirrored, fmt.Sprintf("%s %s", t.Tag.String(), t.Image))
+	}
+	sort.Strings(mirrored)
+	for _, m := range mirrored {
+		fmt.Fprintf(dgstr.Hash(), "Mirror %s\n", m)
+	}
+
+	fmt.Fprintln(dgstr.Hash())
+
 	fmt.Fprintln(dgstr.Hash(), conf.DockerLoadVersion.String())
 	fmt.Fprintln(dgstr.Hash(), conf.DockerVersion.String())
 
+	// A locally built binary keeps its version when rebuilt,
+	// the digest of the cached binary identifies the build
+	binaryDigest, err := c.BuildCache.Digest(conf.DockerVersion)
+	if err != nil {
+		return "", fmt.Errorf("error getting digest of docker %s: %v", conf.DockerVersion, err)
+	}
+	if binaryDigest != "" {
+		fmt.Fprintf(dgstr.Hash(), "Binary %s\n", binaryDigest)
+	}
+
+	daemonNames := make([]string, 0, len(conf.DaemonVersions))
+	for name := range conf.DaemonVersions {
+		daemonNames = append(daemonNames, name)
+	}
+	sort.Strings(daemonNames)
+	for _, name := range daemonNames {
+		fmt.Fprintf(dgstr.Hash(), "Daemon %s %s\n", name, conf.DaemonVersions[name])
+	}
+	if conf.UpgradeFromVersion.Name != "" {
+		fmt.Fprintf(dgstr.Hash(), "Upgrade %s\n", conf.UpgradeFromVersion)
+	}
+
 	imageHash := dgstr.Digest()
 
 	id, err := c.ImageCache.GetImage(imageHash)
@@ -564,18 +1183,38 @@ func BuildBaseImage(client DockerClient, conf BaseImageConfiguration, c CacheCon
 		return "", fmt.Errorf("unable to make images directory: %v", err)
 	}
 
-	for _, img := range images {
-		if err := saveImage(client, filepath.Join(imagesDir, img+".tar"), img); err != nil {
-			return "", fmt.Errorf("error saving image %s: %v", img, err)
+	// Export images while the docker binaries are installed,
+	// when streaming the export happens after the build.
+	exportErr := make(chan error, 1)
+	exported := false
+	defer func() {
+		// The export must finish before the build directory is removed
+		if !exported {
+			<-exportErr
 		}
+	}()
+	if conf.StreamImages || len(images) == 0 {
+		exportErr <- nil
+	} else {
+		go func() {
+			exportErr <- exportImages(client, filepath.Join(imagesDir, imagesArchive), images)
+		}()
+	}
 
+	if conf.StreamImages {
+		if err := os.Mkdir(filepath.Join(imagesDir, imagesExtracted), 0755); err != nil {
+			return "", fmt.Errorf("unable to make images directory: %v", err)
+		}
 	}
 
 	if err := saveTagMap(filepath.Join(imagesDir, "images.json"), tags); err != nil {
 		return "", fmt.Errorf("error saving tag map: %v", err)
 	}
-
-	fmt.Fprintln(df, "COPY ./images /images")
+	if len(mirrorTags) > 0 {
+		if err := saveTagMap(filepath.Join(imagesDir, mirrorTagMap), mirrorTags); err != nil {
+			return "", fmt.Errorf("error saving mirror tag map: %v", err)
+		}
+	}
 
 	// Add Docker Binaries (docker test specific)
 	if err := c.BuildCache.InstallVersion(conf.DockerVersion, filepath.Join(td, "docker")); err != nil {
@@ -586,8 +1225,45 @@ func BuildBaseImage(client DockerClient, conf BaseImageConfiguration, c CacheCon
 	}
 	fmt.Fprintln(df, "COPY ./docker /usr/bin/docker")
 	fmt.Fprintln(df, "COPY ./docker-load /usr/bin/docker-load")
+	for _, name := range daemonNames {
+		v := conf.DaemonVersions[name]
+		binary := filepath.Base(daemonBinary(name))
+		if err := c.BuildCache.InstallVersion(v, filepath.Join(td, binary)); err != nil {
+			return "", fmt.Errorf("error installing docker version %s for daemon %s: %v", v, name, err)
+		}
+		fmt.Fprintf(df, "COPY ./%s /usr/bin/%s\n", binary, binary)
+	}
+	if conf.UpgradeFromVersion.Name != "" {
+		binary := filepath.Base(upgradeBinary)
+		if err := c.BuildCache.InstallVersion(conf.UpgradeFromVersion, filepath.Join(td, binary)); err != nil {
+			return "", fmt.Errorf("error installing docker upgrade version %s: %v", conf.UpgradeFromVersion, err)
+		}
+		fmt.Fprintf(df, "COPY ./%s %s\n", binary, upgradeBinary)
+	}
 	// TODO: Handle init files
 
+	exported = true
+	if err := <-exportErr; err != nil {
+		return "", fmt.Errorf("error exporting images: %v", err)
+	}
+
+	fmt.Fprintln(df, "COPY ./images /images")
+	if err := df.Close(); err != nil {
+		return "", fmt.Errorf("error closing dockerfile: %v", err)
+	}
+
+	var imageID string
+	if conf.StreamImages && len(images) > 0 {
+		imageID, err = buildStreamed(client, td, "golem-base:"+imageHash.Hex()[:12], images)
+		if err != nil {
+			return "", fmt.Errorf("error streaming images: %v", err)
+		}
+		if err := c.ImageCache.SaveImage(imageHash, imageID); err != nil {
+			logrus.Errorf("Unable to save image by hash %s: %s", imageHash, imageID)
+		}
+		return imageID, nil
+	}
+
 	// Call build
 	builder, err := client.NewBuilder(td, "", "")
 	if err != nil {
@@ -601,7 +1277,7 @@ func BuildBaseImage(client DockerClient, conf BaseImageConfiguration, c CacheCon
 	}
 
 	// Update index
-	imageID := builder.ImageID()
+	imageID = builder.ImageID()
 
 	if err := c.ImageCache.SaveImage(imageHash, imageID); err != nil {
 		logrus.Errorf("Unable to save image by hash %s: %s", imageHash, imageID)
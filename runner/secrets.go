@@ -0,0 +1,511 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockerclient "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// SecretAsEnv injects a secret as an environment
+	// variable named after the secret
+	SecretAsEnv = "env"
+
+	// SecretAsFile injects a secret as a file named after
+	// the secret in the tmpfs mounted secrets directory
+	SecretAsFile = "file"
+
+	// SecretsDir is the tmpfs directory inside the test
+	// instance container holding the file secrets
+	SecretsDir = "/run/golem/secrets"
+
+	// secretEnvDir is the hidden directory in the secrets
+	// directory holding the environment secrets
+	secretEnvDir = ".env"
+
+	// secretsReady marks the secrets directory as written
+	secretsReady = ".ready"
+)
+
+var (
+	secretEnvNameRegexp  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	secretFileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+)
+
+// SecretConfiguration is a secret read on the host when the
+// test instance is run. Secret values are never stored in the
+// instance configuration or the instance image.
+type SecretConfiguration struct {
+	// Name is the environment variable or file name
+	// for the secret inside the test instance
+	Name string
+
+	// FromEnv is the host environment variable to read
+	FromEnv string
+
+	// FromFile is the host file to read
+	FromFile string
+
+	// As is how the secret is injected, SecretAsEnv
+	// or SecretAsFile
+	As string
+}
+
+func (sc SecretConfiguration) String() string {
+	source := "env " + sc.FromEnv
+	if sc.FromFile != "" {
+		source = "file " + sc.FromFile
+	}
+	return fmt.Sprintf("%s (%s from %s)", sc.Name, sc.As, source)
+}
+
+// validate returns an error if the secret configuration
+// is not complete or the name is invalid for its type.
+func (sc SecretConfiguration) validate() error {
+	if (sc.FromEnv == "") == (sc.FromFile == "") {
+		return fmt.Errorf("secret %s must have exactly one of fromenv or fromfile", sc.Name)
+	}
+	switch sc.As {
+	case SecretAsEnv:
+		if !secretEnvNameRegexp.MatchString(sc.Name) {
+			return fmt.Errorf("invalid secret environment variable name %q", sc.Name)
+		}
+	case SecretAsFile:
+		if !secretFileNameRegexp.MatchString(sc.Name) {
+			return fmt.Errorf("invalid secret file name %q", sc.Name)
+		}
+	default:
+		return fmt.Errorf("invalid secret type %q for %s, expected %q or %q", sc.As, sc.Name, SecretAsEnv, SecretAsFile)
+	}
+	return nil
+}
+
+// read reads the secret value from the host
+func (sc SecretConfiguration) read() (string, error) {
+	if sc.FromFile != "" {
+		b, err := ioutil.ReadFile(sc.FromFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading secret %s: %v", sc.Name, err)
+		}
+		return string(b), nil
+	}
+	value, ok := os.LookupEnv(sc.FromEnv)
+	if !ok {
+		return "", fmt.Errorf("secret %s not set, missing environment variable %s", sc.Name, sc.FromEnv)
+	}
+	return value, nil
+}
+
+// secretPayload holds the secret values sent by the host to
+// the runner in the instance container
+type secretPayload struct {
+	Env   map[string]string
+	Files map[string][]byte
+}
+
+// readSecrets reads the secrets on the host and returns the
+// payload for the test instance container. The values are
+// registered for redaction.
+func readSecrets(secrets []SecretConfiguration) (*secretPayload, error) {
+	payload := &secretPayload{
+		Env:   map[string]string{},
+		Files: map[string][]byte{},
+	}
+	for _, secret := range secrets {
+		value, err := secret.read()
+		if err != nil {
+			return nil, err
+		}
+		RedactSecrets(value)
+		if secret.As == SecretAsFile {
+			payload.Files[secret.Name] = []byte(value)
+		} else {
+			payload.Env[secret.Name] = value
+		}
+	}
+	return payload, nil
+}
+
+// sendSecrets delivers the secrets to the started instance container
+// by running the runner executable with -write-secrets and writing the
+// payload to its stdin. The values never appear in the container
+// configuration.
+func sendSecrets(client DockerClient, containerID, executable string, payload *secretPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding secrets: %v", err)
+	}
+
+	execOptions := dockerclient.CreateExecOptions{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{executable, "-write-secrets"},
+		Container:    containerID,
+	}
+	e, err := client.CreateExec(execOptions)
+	if err != nil {
+		return fmt.Errorf("error creating exec: %v", err)
+	}
+
+	var output bytes.Buffer
+	startOptions := dockerclient.StartExecOptions{
+		InputStream:  bytes.NewReader(b),
+		OutputStream: &output,
+		ErrorStream:  &output,
+	}
+	if err := client.StartExec(e.ID, startOptions); err != nil {
+		return fmt.Errorf("error starting exec: %v", err)
+	}
+	inspect, err := client.InspectExec(e.ID)
+	if err != nil {
+		return fmt.Errorf("error inspecting exec: %v", err)
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("error writing secrets, exit code %d: %s", inspect.ExitCode, strings.TrimSpace(Redact(output.String())))
+	}
+	return nil
+}
+
+// WriteSecrets reads the secrets sent by the host from r, mounts a
+// tmpfs on the directory and writes the secrets into it. Environment
+// secrets are written to a hidden subdirectory read by LoadSecrets.
+// The directory is marked ready once all secrets are written.
+func WriteSecrets(dir string, r io.Reader) error {
+	var payload secretPayload
+	if err := json.NewDecoder(r).Decode(&payload); err != nil {
+		return fmt.Errorf("error decoding secrets: %v", err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating secrets directory: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOEXEC|syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0700"); err != nil {
+		return fmt.Errorf("error mounting secrets directory: %v", err)
+	}
+	for name, b := range payload.Files {
+		if !secretFileNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid secret file name %q", name)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			return fmt.Errorf("error writing secret %s: %v", name, err)
+		}
+	}
+	envDir := filepath.Join(dir, secretEnvDir)
+	if err := os.Mkdir(envDir, 0700); err != nil {
+		return fmt.Errorf("error creating secrets directory: %v", err)
+	}
+	for name, value := range payload.Env {
+		if !secretEnvNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid secret environment variable name %q", name)
+		}
+		if err := ioutil.WriteFile(filepath.Join(envDir, name), []byte(value), 0600); err != nil {
+			return fmt.Errorf("error writing secret %s: %v", name, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, secretsReady), nil, 0600); err != nil {
+		return fmt.Errorf("error marking secrets ready: %v", err)
+	}
+	return nil
+}
+
+// WaitSecrets waits until the secrets written by the host
+// are ready in the directory.
+func WaitSecrets(dir string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := os.Stat(filepath.Join(dir, secretsReady))
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("error checking secrets: %v", err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for secrets after %s", timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// LoadSecrets sets the environment secrets written to the
+// directory in the environment of the current process and
+// registers all secret values for redaction. Nothing is
+// loaded when no secrets were written.
+func LoadSecrets(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, secretsReady)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error checking secrets: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading secrets directory: %v", err)
+	}
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return fmt.Errorf("error reading secret %s: %v", fi.Name(), err)
+		}
+		RedactSecrets(string(b))
+	}
+
+	envDir := filepath.Join(dir, secretEnvDir)
+	envFiles, err := ioutil.ReadDir(envDir)
+	if err != nil {
+		return fmt.Errorf("error reading secrets directory: %v", err)
+	}
+	for _, fi := range envFiles {
+		b, err := ioutil.ReadFile(filepath.Join(envDir, fi.Name()))
+		if err != nil {
+			return fmt.Errorf("error reading secret %s: %v", fi.Name(), err)
+		}
+		RedactSecrets(string(b))
+		if err := os.Setenv(fi.Name(), string(b)); err != nil {
+			return fmt.Errorf("error setting secret %s: %v", fi.Name(), err)
+		}
+		logrus.Debugf("Loaded secret %s", fi.Name())
+	}
+	return nil
+}
+
+// RedactSecretEnv registers the values of the environment
+// variables for redaction.
+func RedactSecretEnv(names []string) {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			RedactSecrets(value)
+		}
+	}
+}
+
+// redactor replaces secret values in log output
+var redactor = &secretRedactor{}
+
+// RedactSecrets registers secret values which are replaced
+// in golem's log output and by Redact. The first registration
+// installs the redacting formatter on the standard logger.
+func RedactSecrets(values ...string) {
+	var forms []string
+	for _, value := range values {
+		forms = append(forms, secretForms(value)...)
+	}
+	redactor.add(forms...)
+}
+
+// secretForms returns the value along with the encoded forms it
+// is passed around in, base64 and JSON string escaped, and each
+// line of a multi-line value since output is redacted per line.
+func secretForms(value string) []string {
+	forms := []string{value, base64.StdEncoding.EncodeToString([]byte(value))}
+	if b, err := json.Marshal(value); err == nil {
+		forms = append(forms, string(b[1:len(b)-1]))
+	}
+	if strings.Contains(value, "\n") {
+		forms = append(forms, strings.Split(value, "\n")...)
+	}
+	return forms
+}
+
+// Redact returns the string with all registered
+// secret values replaced.
+func Redact(s string) string {
+	return redactor.redact(s)
+}
+
+// RedactStream redacts the next chunk of streamed output. The end
+// of the chunk which may be the start of a secret continued in the
+// next chunk is held back and returned as the remainder to prepend
+// to the next chunk. When final, the whole chunk is redacted.
+func RedactStream(s string, final bool) (string, string) {
+	return redactor.redactStream(s, final)
+}
+
+const redacted = "<redacted>"
+
+type secretRedactor struct {
+	l        sync.RWMutex
+	values   []string
+	seen     map[string]struct{}
+	replacer *strings.Replacer
+	once     sync.Once
+}
+
+func (r *secretRedactor) add(values ...string) {
+	r.once.Do(func() {
+		logrus.SetFormatter(redactingFormatter{Formatter: logrus.StandardLogger().Formatter})
+	})
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	for _, value := range values {
+		// Short values would redact unrelated output
+		if len(strings.TrimSpace(value)) < 4 {
+			continue
+		}
+		if _, ok := r.seen[value]; ok {
+			continue
+		}
+		if r.seen == nil {
+			r.seen = map[string]struct{}{}
+		}
+		r.seen[value] = struct{}{}
+		r.values = append(r.values, value)
+	}
+	// Replace longer values first so a secret containing
+	// another secret is fully redacted
+	sort.Sort(byLength(r.values))
+	oldnew := make([]string, 0, len(r.values)*2)
+	for _, value := range r.values {
+		oldnew = append(oldnew, value, redacted)
+	}
+	r.replacer = strings.NewReplacer(oldnew...)
+}
+
+func (r *secretRedactor) redact(s string) string {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	if r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+func (r *secretRedactor) redactStream(s string, final bool) (string, string) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	if r.replacer == nil {
+		return s, ""
+	}
+	if final {
+		return r.replacer.Replace(s), ""
+	}
+
+	// Hold back less than the longest secret, moving the cut
+	// before any secret crossing it
+	cut := len(s) - len(r.values[0]) + 1
+	if cut <= 0 {
+		return "", s
+	}
+	for moved := true; moved; {
+		moved = false
+		for _, value := range r.values {
+			start, end := cut-len(value)+1, cut+len(value)-1
+			if start < 0 {
+				start = 0
+			}
+			if end > len(s) {
+				end = len(s)
+			}
+			if i := strings.Index(s[start:end], value); i >= 0 && start+i < cut {
+				cut = start + i
+				moved = true
+			}
+		}
+	}
+	return r.replacer.Replace(s[:cut]), s[cut:]
+}
+
+type byLength []string
+
+func (b byLength) Len() int           { return len(b) }
+func (b byLength) Less(i, j int) bool { return len(b[i]) > len(b[j]) }
+func (b byLength) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// redactingFormatter redacts secret values from log entries
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	b, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(Redact(string(b))), nil
+}
+
+// maxRedactBuffer is the longest output held back waiting
+// for the end of a line before it is redacted and written
+const maxRedactBuffer = 64 * 1024
+
+// redactingWriter redacts secret values from output written to
+// a log file. Output is redacted per line so a secret split
+// across writes is still replaced.
+type redactingWriter struct {
+	l      sync.Mutex
+	w      io.Writer
+	buf    []byte
+	closed bool
+}
+
+// newRedactingWriter returns a writer redacting
+// the output written to w
+func newRedactingWriter(w io.Writer) *redactingWriter {
+	return &redactingWriter{w: w}
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	rw.l.Lock()
+	defer rw.l.Unlock()
+	if rw.closed {
+		return len(p), nil
+	}
+	rw.buf = append(rw.buf, p...)
+	n := bytes.LastIndexByte(rw.buf, '\n') + 1
+	if n == 0 && len(rw.buf) > maxRedactBuffer {
+		n = len(rw.buf)
+	}
+	if n > 0 {
+		if _, err := io.WriteString(rw.w, Redact(string(rw.buf[:n]))); err != nil {
+			return 0, err
+		}
+		rw.buf = rw.buf[:copy(rw.buf, rw.buf[n:])]
+	}
+	return len(p), nil
+}
+
+// Flush redacts and writes any buffered partial line
+func (rw *redactingWriter) Flush() error {
+	rw.l.Lock()
+	defer rw.l.Unlock()
+	return rw.flush()
+}
+
+// Close flushes the writer, later writes are discarded
+// so the underlying writer may be closed while output
+// is still being copied to the redacting writer.
+func (rw *redactingWriter) Close() error {
+	rw.l.Lock()
+	defer rw.l.Unlock()
+	rw.closed = true
+	return rw.flush()
+}
+
+func (rw *redactingWriter) flush() error {
+	if len(rw.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(rw.w, Redact(string(rw.buf)))
+	rw.buf = rw.buf[:0]
+	return err
+}
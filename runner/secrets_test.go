@@ -0,0 +1,100 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	secret := "golem-test-secret"
+	key := "-----BEGIN KEY-----\nc2VjcmV0LWtleS1ib2R5\n-----END KEY-----"
+	RedactSecrets(secret, key)
+
+	var buf bytes.Buffer
+	w := newRedactingWriter(&buf)
+	writes := []string{
+		"password golem-te", "st-secret\n",
+		"encoded " + base64.StdEncoding.EncodeToString([]byte(secret)) + "\n",
+		"key c2VjcmV0LWtl", "eS1ib2R5 end",
+	}
+	for _, s := range writes {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Contains(buf.String(), "end") {
+		t.Fatalf("Unexpected partial line written: %q", buf.String())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "password <redacted>\nencoded <redacted>\nkey <redacted> end"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("Unexpected output\n\tExpected: %q\n\tActual:   %q", expected, actual)
+	}
+}
+
+func TestRedactStream(t *testing.T) {
+	secret := "golem-stream-secret"
+	RedactSecrets(secret)
+
+	chunks := []string{"first golem-str", "eam-secret second golem", "-stream-secret third"}
+	var output, pending string
+	for i, chunk := range chunks {
+		out, rest := RedactStream(pending+chunk, i == len(chunks)-1)
+		output += out
+		pending = rest
+	}
+	if pending != "" {
+		t.Fatalf("Unexpected remainder after final chunk: %q", pending)
+	}
+
+	expected := "first <redacted> second <redacted> third"
+	if output != expected {
+		t.Fatalf("Unexpected output\n\tExpected: %q\n\tActual:   %q", expected, output)
+	}
+}
+
+func TestSecretFromFileRelativeToSuite(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-secrets-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	if err := ioutil.WriteFile(filepath.Join(td, "token.key"), []byte("golem-file-secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := suiteConfiguration{
+		Name:    "secrets",
+		Secrets: []secretConfiguration{{Name: "token.key", FromFile: "token.key", As: SecretAsFile}},
+	}
+	cs, err := newSuiteConfiguration(td, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := cs.Instances()
+	if len(instances) != 1 || len(instances[0].Secrets) != 1 {
+		t.Fatalf("Unexpected instances %#v", instances)
+	}
+	secret := instances[0].Secrets[0]
+	if expected := filepath.Join(td, "token.key"); secret.FromFile != expected {
+		t.Fatalf("Unexpected secret file\n\tExpected: %s\n\tActual:   %s", expected, secret.FromFile)
+	}
+	payload, err := readSecrets(instances[0].Secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := string(payload.Files["token.key"]); actual != "golem-file-secret" {
+		t.Fatalf("Unexpected secret value %q", actual)
+	}
+	if config.Secrets[0].FromFile != "token.key" {
+		t.Fatalf("Suite configuration modified: %q", config.Secrets[0].FromFile)
+	}
+}
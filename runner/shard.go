@@ -0,0 +1,247 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ShardIndexEnv and ShardTotalEnv are the environment variables
+	// set in each shard container with the zero based index of
+	// the shard and the number of shards.
+	ShardIndexEnv = "GOLEM_SHARD_INDEX"
+	ShardTotalEnv = "GOLEM_SHARD_TOTAL"
+
+	// ShardFilesEnv is the environment variable set for test
+	// runners with the space separated test files of the shard.
+	ShardFilesEnv = "GOLEM_SHARD_FILES"
+
+	// defaultShardFiles is the glob of test files split
+	// between shards when none is configured
+	defaultShardFiles = "*.bats"
+)
+
+// ShardConfiguration is the configuration for splitting the
+// test files of a suite across multiple instance containers.
+type ShardConfiguration struct {
+	// Total is the number of shards
+	Total int `json:"total"`
+
+	// Files is the glob of test files in the suite
+	// directory which are split between the shards
+	Files string `json:"files"`
+}
+
+// shard is a single instance container of a
+// possibly sharded instance.
+type shard struct {
+	name   string
+	logDir string
+	env    []string
+
+	// index is the index of the shard, only
+	// set when the instance is sharded
+	index int
+}
+
+// shards returns the containers to run for an instance,
+// a single container unless the instance is sharded.
+func (r *Runner) shards(instance InstanceConfiguration) []shard {
+	logDir := r.logDir(instance.Name)
+	if instance.Shards == nil || instance.Shards.Total <= 1 {
+		return []shard{{name: instance.Name, logDir: logDir}}
+	}
+	shards := make([]shard, instance.Shards.Total)
+	for i := range shards {
+		shards[i] = shard{
+			name:  shardName(instance.Name, i),
+			index: i,
+			env: []string{
+				ShardIndexEnv + "=" + strconv.Itoa(i),
+				ShardTotalEnv + "=" + strconv.Itoa(instance.Shards.Total),
+			},
+		}
+		if logDir != "" {
+			shards[i].logDir = filepath.Join(logDir, shardDir(i))
+		}
+	}
+	return shards
+}
+
+func shardName(instance string, index int) string {
+	return fmt.Sprintf("%s-shard-%d", instance, index)
+}
+
+func shardDir(index int) string {
+	return fmt.Sprintf("shard-%d", index)
+}
+
+// ShardFiles returns the test files of the shard given by the shard
+// environment variables, relative to the suite directory. Files
+// matching the glob are sorted and assigned to shards in turn. If
+// the instance is not sharded, false is returned.
+func ShardFiles(dir string, conf *ShardConfiguration) ([]string, bool, error) {
+	if conf == nil || conf.Total <= 1 {
+		return nil, false, nil
+	}
+	index, err := strconv.Atoi(os.Getenv(ShardIndexEnv))
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid shard index %q: %v", os.Getenv(ShardIndexEnv), err)
+	}
+	total, err := strconv.Atoi(os.Getenv(ShardTotalEnv))
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid shard total %q: %v", os.Getenv(ShardTotalEnv), err)
+	}
+	if index < 0 || index >= total {
+		return nil, false, fmt.Errorf("shard index %d out of range for %d shards", index, total)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, conf.Files))
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid shard files %q: %v", conf.Files, err)
+	}
+	sort.Strings(matches)
+	var files []string
+	for i, match := range matches {
+		if i%total != index {
+			continue
+		}
+		rel, err := filepath.Rel(dir, match)
+		if err != nil {
+			return nil, false, err
+		}
+		files = append(files, rel)
+	}
+	return files, true, nil
+}
+
+// shardCommand returns the test command running only the shard's
+// test files in place of the "." argument for the suite directory.
+// A command without a "." argument is returned unchanged, sharded
+// test runners are required to have one.
+func shardCommand(command, files []string) []string {
+	sharded := make([]string, 0, len(command)+len(files))
+	var replaced bool
+	for _, arg := range command {
+		if arg == "." && !replaced {
+			sharded = append(sharded, files...)
+			replaced = true
+			continue
+		}
+		sharded = append(sharded, arg)
+	}
+	return sharded
+}
+
+// hasSuiteDirArg returns whether the command has a "."
+// argument for the suite directory to replace with files
+func hasSuiteDirArg(command []string) bool {
+	for _, arg := range command {
+		if arg == "." {
+			return true
+		}
+	}
+	return false
+}
+
+// shardScripts returns the test scripts running only the
+// shard's test files, with the files in the environment
+func shardScripts(scripts []TestScript, files []string) []TestScript {
+	sharded := make([]TestScript, len(scripts))
+	for i, script := range scripts {
+		script.Command = shardCommand(script.Command, files)
+		script.Env = append(append([]string{}, script.Env...), ShardFilesEnv+"="+strings.Join(files, " "))
+		sharded[i] = script
+	}
+	return sharded
+}
+
+// mergeShards merges the status of each shard of an instance into a
+// single status for the instance. The merged instance passed only if
+// every shard passed, phase durations are the longest of the shards.
+func mergeShards(name, suite, logDir string, shards []InstanceStatus) InstanceStatus {
+	merged := InstanceStatus{
+		Name:      name,
+		Suite:     suite,
+		LogDir:    logDir,
+		Durations: map[Phase]time.Duration{},
+		Finished:  true,
+		Phase:     PhasePassed,
+	}
+	var errs []string
+	for _, s := range shards {
+		if merged.Started.IsZero() || (!s.Started.IsZero() && s.Started.Before(merged.Started)) {
+			merged.Started = s.Started
+		}
+		if s.Updated.After(merged.Updated) {
+			merged.Updated = s.Updated
+		}
+		merged.Results = append(merged.Results, s.Results...)
+		merged.Scripts = append(merged.Scripts, s.Scripts...)
+		for _, logFile := range s.LogFiles {
+			merged.LogFiles = append(merged.LogFiles, filepath.ToSlash(filepath.Join(shardDir(s.Shard), logFile)))
+		}
+		for phase, d := range s.Durations {
+			if d > merged.Durations[phase] {
+				merged.Durations[phase] = d
+			}
+		}
+		if s.Error != "" {
+			errs = append(errs, fmt.Sprintf("%s: %s", s.Name, s.Error))
+		}
+
+		switch {
+		case !s.Finished:
+			if merged.Finished {
+				merged.Phase = s.Phase
+			}
+			merged.Finished = false
+		case merged.Finished && s.Phase == PhaseFailed:
+			merged.Phase = PhaseFailed
+		}
+	}
+	merged.Error = strings.Join(errs, "; ")
+	return merged
+}
+
+// MergeShards returns the instance statuses with the
+// statuses of the shards of an instance merged.
+func MergeShards(instances []InstanceStatus) []InstanceStatus {
+	var merged []InstanceStatus
+	shards := map[string][]InstanceStatus{}
+	for _, instance := range instances {
+		if instance.ShardOf == "" {
+			merged = append(merged, instance)
+			continue
+		}
+		if _, ok := shards[instance.ShardOf]; !ok {
+			// Placeholder keeping the order of the instances
+			merged = append(merged, InstanceStatus{Name: instance.ShardOf})
+		}
+		shards[instance.ShardOf] = append(shards[instance.ShardOf], instance)
+	}
+	for i, instance := range merged {
+		s, ok := shards[instance.Name]
+		if !ok {
+			continue
+		}
+		sort.Sort(byShard(s))
+		var logDir string
+		if s[0].LogDir != "" {
+			logDir = filepath.Dir(s[0].LogDir)
+		}
+		merged[i] = mergeShards(instance.Name, s[0].Suite, logDir, s)
+	}
+	return merged
+}
+
+type byShard []InstanceStatus
+
+func (b byShard) Len() int           { return len(b) }
+func (b byShard) Less(i, j int) bool { return b[i].Shard < b[j].Shard }
+func (b byShard) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
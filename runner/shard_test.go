@@ -0,0 +1,107 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestShardFiles(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-shard-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	for _, name := range []string{"a.bats", "b.bats", "c.bats", "d.bats", "e.bats", "helpers.bash"} {
+		if err := ioutil.WriteFile(filepath.Join(td, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Unsetenv(ShardIndexEnv)
+	defer os.Unsetenv(ShardTotalEnv)
+
+	conf := &ShardConfiguration{Total: 2, Files: "*.bats"}
+	expected := [][]string{{"a.bats", "c.bats", "e.bats"}, {"b.bats", "d.bats"}}
+	for index, files := range expected {
+		os.Setenv(ShardIndexEnv, []string{"0", "1"}[index])
+		os.Setenv(ShardTotalEnv, "2")
+		shardFiles, sharded, err := ShardFiles(td, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sharded || !reflect.DeepEqual(shardFiles, files) {
+			t.Errorf("shard %d: unexpected files %v", index, shardFiles)
+		}
+	}
+
+	if _, sharded, err := ShardFiles(td, nil); err != nil || sharded {
+		t.Errorf("unexpected sharding without configuration: %v", err)
+	}
+
+	command := shardCommand([]string{"bats", "-t", "."}, expected[1])
+	if !reflect.DeepEqual(command, []string{"bats", "-t", "b.bats", "d.bats"}) {
+		t.Errorf("unexpected command %v", command)
+	}
+}
+
+func TestShardRunnerRequiresSuiteDir(t *testing.T) {
+	config := suiteConfiguration{
+		Name:   "registry",
+		Shards: 2,
+		Runner: []testRunConfiguration{{Command: "bats -t .", Format: "tap"}},
+	}
+	if _, err := newSuiteConfiguration("", config); err != nil {
+		t.Fatal(err)
+	}
+	// Appending the shard files would run the whole suite in every shard
+	config.Runner[0].Command = "bats -t tests/"
+	if _, err := newSuiteConfiguration("", config); err == nil {
+		t.Fatalf("Expected error for sharded test runner without \".\" argument")
+	}
+}
+
+func TestShardsRejectUpgrade(t *testing.T) {
+	config := suiteConfiguration{
+		Name:    "registry",
+		Dind:    true,
+		Shards:  2,
+		Runner:  []testRunConfiguration{{Command: "bats -t .", Format: "tap"}},
+		Upgrade: &upgradeConfiguration{From: "1.9.1"},
+	}
+	if _, err := newSuiteConfiguration("", config); err == nil {
+		t.Fatalf("Expected error for shards with upgrade")
+	}
+}
+
+func TestMergeShards(t *testing.T) {
+	instances := []InstanceStatus{
+		{Name: "notary", Phase: PhasePassed, Finished: true},
+		{Name: "registry-shard-1", ShardOf: "registry", Shard: 1, Phase: PhaseFailed, Finished: true, Error: "instance exited with code 1",
+			Results: []TestResult{{Name: "pull", Status: TestFailed}}, LogFiles: []string{"output"}, LogDir: "/runs/1/registry/shard-1"},
+		{Name: "registry-shard-0", ShardOf: "registry", Shard: 0, Phase: PhasePassed, Finished: true,
+			Results: []TestResult{{Name: "push", Status: TestPassed}}, LogFiles: []string{"output"}, LogDir: "/runs/1/registry/shard-0"},
+	}
+
+	merged := MergeShards(instances)
+	if len(merged) != 2 {
+		t.Fatalf("unexpected instances %#v", merged)
+	}
+	registry := merged[1]
+	if registry.Name != "registry" || registry.Phase != PhaseFailed || !registry.Finished {
+		t.Errorf("unexpected merged status %#v", registry)
+	}
+	if len(registry.Results) != 2 || registry.Results[0].Name != "push" {
+		t.Errorf("unexpected merged results %#v", registry.Results)
+	}
+	if !reflect.DeepEqual(registry.LogFiles, []string{"shard-0/output", "shard-1/output"}) {
+		t.Errorf("unexpected merged log files %v", registry.LogFiles)
+	}
+	if registry.LogDir != "/runs/1/registry" {
+		t.Errorf("unexpected merged log dir %s", registry.LogDir)
+	}
+	if registry.Error != "registry-shard-1: instance exited with code 1" {
+		t.Errorf("unexpected merged error %q", registry.Error)
+	}
+}
@@ -0,0 +1,216 @@
+package runner
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// InstanceStatus is the current status of a test instance
+// built from the events received for the instance.
+type InstanceStatus struct {
+	Name     string         `json:"name"`
+	Suite    string         `json:"suite"`
+	Phase    Phase          `json:"phase"`
+	Started  time.Time      `json:"started"`
+	Updated  time.Time      `json:"updated"`
+	Results  []TestResult   `json:"results"`
+	Scripts  []ScriptResult `json:"scripts"`
+	LogFiles []string       `json:"logfiles"`
+	Error    string         `json:"error,omitempty"`
+
+	// Durations are the durations of each finished phase
+	Durations map[Phase]time.Duration `json:"durations"`
+
+	// Finished is whether the instance has finished
+	Finished bool `json:"finished"`
+
+	// ShardOf is the name of the sharded instance when
+	// this is the status of a shard, with the index of
+	// the shard as Shard
+	ShardOf string `json:"shardof,omitempty"`
+	Shard   int    `json:"shard,omitempty"`
+
+	// LogDir is the directory the instance logs are
+	// collected into on the host
+	LogDir string `json:"-"`
+}
+
+func (s *InstanceStatus) update(event Event) {
+	if s.Started.IsZero() {
+		s.Started = event.Time
+	}
+	s.Updated = event.Time
+	switch event.Type {
+	case EventPhaseStarted:
+		s.Phase = event.Phase
+	case EventPhaseFinished:
+		if s.Durations == nil {
+			s.Durations = map[Phase]time.Duration{}
+		}
+		s.Durations[event.Phase] += event.Duration
+	case EventScriptExited:
+		if event.Script != nil {
+			s.Scripts = append(s.Scripts, *event.Script)
+		}
+	case EventTestResult:
+		if event.Result != nil {
+			s.Results = append(s.Results, *event.Result)
+		}
+	case EventLogFile:
+		s.LogFiles = append(s.LogFiles, event.LogFile)
+	case EventInstanceFinished:
+		s.Phase = event.Phase
+		s.Finished = true
+	}
+	if event.Error != "" {
+		s.Error = event.Error
+	}
+}
+
+func (s *InstanceStatus) copy() InstanceStatus {
+	c := *s
+	c.Results = append([]TestResult{}, s.Results...)
+	c.Scripts = append([]ScriptResult{}, s.Scripts...)
+	c.LogFiles = append([]string{}, s.LogFiles...)
+	c.Durations = make(map[Phase]time.Duration, len(s.Durations))
+	for p, d := range s.Durations {
+		c.Durations[p] = d
+	}
+	return c
+}
+
+// Monitor tracks the status of every test instance in a run
+// from the events reported by the host and the runner inside
+// each instance container. Events are passed on to handlers
+// and subscribers.
+type Monitor struct {
+	l           sync.Mutex
+	instances   map[string]*InstanceStatus
+	handlers    []EventReporter
+	subscribers map[chan Event]struct{}
+}
+
+// NewMonitor creates a new monitor with no instances
+func NewMonitor() *Monitor {
+	return &Monitor{
+		instances:   map[string]*InstanceStatus{},
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// addInstance adds an instance to the monitor
+func (m *Monitor) addInstance(suite, name, logDir string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.instances[name] = &InstanceStatus{
+		Name:   name,
+		Suite:  suite,
+		LogDir: logDir,
+	}
+}
+
+// addShard adds a shard of an instance to the monitor
+func (m *Monitor) addShard(suite, instance string, index int, name, logDir string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.instances[name] = &InstanceStatus{
+		Name:    name,
+		Suite:   suite,
+		ShardOf: instance,
+		Shard:   index,
+		LogDir:  logDir,
+	}
+}
+
+// Handle adds a handler which is called with every event
+// in the order received. Handlers must not block.
+func (m *Monitor) Handle(handler EventReporter) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
+
+// Report updates the status of the event's instance and
+// sends the event to all handlers and subscribers.
+func (m *Monitor) Report(event Event) {
+	if event.Version == 0 {
+		event.Version = EventVersion
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	m.l.Lock()
+	defer m.l.Unlock()
+	status, ok := m.instances[event.Instance]
+	if !ok {
+		status = &InstanceStatus{Name: event.Instance}
+		m.instances[event.Instance] = status
+	}
+	status.update(event)
+
+	for _, handler := range m.handlers {
+		handler.Report(event)
+	}
+	for c := range m.subscribers {
+		select {
+		case c <- event:
+		default:
+			logrus.Debugf("Dropping event for slow subscriber")
+		}
+	}
+}
+
+// Instances returns the status of all instances
+// sorted by name.
+func (m *Monitor) Instances() []InstanceStatus {
+	m.l.Lock()
+	defer m.l.Unlock()
+	instances := make([]InstanceStatus, 0, len(m.instances))
+	for _, status := range m.instances {
+		instances = append(instances, status.copy())
+	}
+	sort.Sort(byInstanceName(instances))
+	return instances
+}
+
+// Instance returns the status of the named instance
+func (m *Monitor) Instance(name string) (InstanceStatus, bool) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	status, ok := m.instances[name]
+	if !ok {
+		return InstanceStatus{}, false
+	}
+	return status.copy(), true
+}
+
+// Subscribe returns a channel receiving the events reported
+// after subscribing and a function to unsubscribe. Events are
+// dropped when the channel is full, use Handle to receive
+// every event.
+func (m *Monitor) Subscribe() (<-chan Event, func()) {
+	c := make(chan Event, 100)
+	m.l.Lock()
+	m.subscribers[c] = struct{}{}
+	m.l.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			m.l.Lock()
+			delete(m.subscribers, c)
+			m.l.Unlock()
+			close(c)
+		})
+	}
+}
+
+type byInstanceName []InstanceStatus
+
+func (b byInstanceName) Len() int           { return len(b) }
+func (b byInstanceName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byInstanceName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
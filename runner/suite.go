@@ -3,12 +3,14 @@ package runner
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -25,9 +27,46 @@ type SuiteRunnerConfiguration struct {
 	DockerLoadLogCapturer LogCapturer
 	DockerLogCapturer     LogCapturer
 
-	ComposeFile     string
+	// ComposeFiles are the compose files for the suite, in
+	// order, if empty compose is not run.
+	ComposeFiles    []string
 	ComposeCapturer LogCapturer
 
+	// ComposeLogDir is the directory to write the log file
+	// for each compose service along with the inspect output
+	// of the compose containers after they are stopped.
+	ComposeLogDir string
+
+	// RegistryMirror runs a registry mirror for the test
+	// daemon serving the images from the mirror tag map.
+	RegistryMirror bool
+
+	// UpgradeLogCapturer is the log capturer for the daemon
+	// run before the upgrade when running an upgrade test
+	UpgradeLogCapturer LogCapturer
+
+	// NamedDaemonLogCapturers are the log capturers for
+	// each named daemon in the run configuration
+	NamedDaemonLogCapturers map[string]LogCapturer
+
+	// PostTestLogCapturer and OnFailureLogCapturer are the log
+	// capturers for the post test and on failure scripts
+	PostTestLogCapturer  LogCapturer
+	OnFailureLogCapturer LogCapturer
+
+	// Events receives the event stream of the suite, if
+	// nil no events are reported.
+	Events EventReporter
+
+	// LogDir is the directory the log capturers write to,
+	// log files are reported relative to this directory.
+	LogDir string
+
+	// Sharded is whether the instance is a shard, only
+	// running the tests in ShardFiles.
+	Sharded    bool
+	ShardFiles []string
+
 	RunConfiguration RunConfiguration
 	SetupLogCapturer LogCapturer
 	TestCapturer     LogCapturer
@@ -38,12 +77,21 @@ type SuiteRunnerConfiguration struct {
 type SuiteRunner struct {
 	config SuiteRunnerConfiguration
 
-	daemonCloser func() error
+	daemonClosers []func() error
+	mirrorCloser  func() error
+	composeLogs   *composeLogCollector
+
+	// upgradeErr is the error from running the tests
+	// before the upgrade, reported with the test results
+	upgradeErr error
 }
 
 // NewSuiteRunner creates a new SuiteRunner with the provided
 // suite runner configuration.
 func NewSuiteRunner(config SuiteRunnerConfiguration) *SuiteRunner {
+	if config.Events == nil {
+		config.Events = nopReporter{}
+	}
 	return &SuiteRunner{
 		config: config,
 	}
@@ -53,104 +101,296 @@ func NewSuiteRunner(config SuiteRunnerConfiguration) *SuiteRunner {
 // any docker images, running setup scripts, and starting the docker
 // daemon used by the tests.
 func (sr *SuiteRunner) Setup() error {
-	// Setup /var/lib/docker
 	if sr.config.DockerInDocker {
-		// Check if empty
-		info, err := ioutil.ReadDir("/var/lib/docker")
+		finished := sr.startPhase(PhaseLoading)
+		err := sr.loadDockerImages()
+		finished(err)
 		if err != nil {
-			return fmt.Errorf("error reading /var/lib/docker: %v", err)
+			return err
 		}
+	}
 
-		if len(info) != 0 {
-			// TODO: Clean if configuration is set
-			logrus.Debugf("/var/lib/docker is not clean")
+	finished := sr.startPhase(PhaseSetup)
+	err := sr.setup()
+	finished(err)
+	return err
+}
 
-			loadVersion, err := versionutil.BinaryVersion("/usr/bin/docker-load")
-			if err != nil {
-				return err
-			}
+// startPhase reports the phase as started and returns a function
+// which reports the phase as finished with the resulting error.
+func (sr *SuiteRunner) startPhase(phase Phase) func(error) {
+	sr.config.Events.Report(Event{Type: EventPhaseStarted, Phase: phase})
+	start := time.Now()
+	return func(err error) {
+		event := Event{
+			Type:     EventPhaseFinished,
+			Phase:    phase,
+			Duration: time.Since(start),
+		}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		sr.config.Events.Report(event)
+	}
+}
 
-			if err := cleanDockerGraph("/var/lib/docker", loadVersion); err != nil {
-				return err
+// loadDockerImages cleans the docker graph and loads the images for the
+// suite using the load daemon. When upgrading, the graph is always reset
+// and the images are loaded by the daemon being upgraded from, so the
+// upgrade starts from a graph in that daemon's format.
+func (sr *SuiteRunner) loadDockerImages() error {
+	// Check if empty
+	info, err := ioutil.ReadDir("/var/lib/docker")
+	if err != nil {
+		return fmt.Errorf("error reading /var/lib/docker: %v", err)
+	}
+
+	loadBinary := "/usr/bin/docker-load"
+	if upgrade := sr.config.RunConfiguration.Upgrade; upgrade != nil {
+		loadBinary = upgrade.Binary
+		// A graph from a previous run was already migrated
+		logrus.Debugf("Resetting /var/lib/docker before upgrade")
+		for _, fi := range info {
+			if err := os.RemoveAll(filepath.Join("/var/lib/docker", fi.Name())); err != nil {
+				return fmt.Errorf("error resetting /var/lib/docker: %v", err)
 			}
 		}
+	} else if len(info) != 0 {
+		logrus.Debugf("/var/lib/docker is not clean")
 
-		// Load tag map
-		logrus.Debugf("Loading docker images")
-		pc, pk, err := StartDaemon("/usr/bin/docker-load", sr.config.DockerLoadLogCapturer)
+		loadVersion, err := versionutil.BinaryVersion("/usr/bin/docker-load")
 		if err != nil {
-			return fmt.Errorf("error starting daemon: %v", err)
+			return err
 		}
 
-		// Remove all containers
-		containers, err := pc.ListContainers(dockerclient.ListContainersOptions{All: true})
-		if err != nil {
-			return fmt.Errorf("error listing containers: %v", err)
-		}
-		for _, container := range containers {
-			logrus.Debugf("Removing container %s", container.ID)
-			removeOptions := dockerclient.RemoveContainerOptions{
-				ID:            container.ID,
-				RemoveVolumes: true,
-				Force:         true,
-			}
-			if err := pc.RemoveContainer(removeOptions); err != nil {
-				return fmt.Errorf("error removing container: %v", err)
-			}
+		if err := cleanDockerGraph("/var/lib/docker", loadVersion, sr.config.CleanDockerGraph); err != nil {
+			return err
 		}
+	}
 
-		if err := syncImages(pc, "/images"); err != nil {
-			return fmt.Errorf("error syncing images: %v", err)
-		}
+	// Load tag map
+	logrus.Debugf("Loading docker images")
+	pc, pk, err := StartDaemon("load", loadBinary, sr.config.DockerLoadLogCapturer, sr.config.RunConfiguration.LoadDaemon)
+	if err != nil {
+		return fmt.Errorf("error starting daemon: %v", err)
+	}
 
-		logrus.Debugf("Stopping daemon")
-		if err := pk(); err != nil {
-			return fmt.Errorf("error killing daemon %v", err)
+	// Remove all containers
+	containers, err := pc.ListContainers(dockerclient.ListContainersOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("error listing containers: %v", err)
+	}
+	for _, container := range containers {
+		logrus.Debugf("Removing container %s", container.ID)
+		removeOptions := dockerclient.RemoveContainerOptions{
+			ID:            container.ID,
+			RemoveVolumes: true,
+			Force:         true,
 		}
+		if err := pc.RemoveContainer(removeOptions); err != nil {
+			return fmt.Errorf("error removing container: %v", err)
+		}
+	}
+
+	if err := syncImages(pc, "/images"); err != nil {
+		return fmt.Errorf("error syncing images: %v", err)
 	}
 
+	logrus.Debugf("Stopping daemon")
+	if err := pk(); err != nil {
+		return fmt.Errorf("error killing daemon %v", err)
+	}
+
+	return nil
+}
+
+// setup runs the setup scripts and starts the test daemons
+// and compose services.
+func (sr *SuiteRunner) setup() error {
 	// Run all setup scripts
 	for _, setupScript := range sr.config.RunConfiguration.Setup {
-		if err := RunScript(sr.config.SetupLogCapturer, setupScript); err != nil {
+		if err := sr.runScript("setup", sr.config.SetupLogCapturer, sr.withEnv(setupScript)); err != nil {
 			return fmt.Errorf("error running setup script %s: %s", setupScript.Command[0], err)
 		}
 	}
 
 	// Start Docker-in-Docker daemon for tests, build compose images
 	if sr.config.DockerInDocker {
+		daemonConfig := sr.config.RunConfiguration.Daemon
+		if sr.config.RegistryMirror {
+			mirror, closer, err := StartRegistryMirror("/images")
+			if err != nil {
+				return fmt.Errorf("error starting registry mirror: %v", err)
+			}
+			sr.mirrorCloser = closer
+			daemonConfig.Args = append(append([]string{}, daemonConfig.Args...), "--registry-mirror="+mirror)
+		}
+
+		if upgrade := sr.config.RunConfiguration.Upgrade; upgrade != nil {
+			if err := sr.runBeforeUpgrade(upgrade, daemonConfig); err != nil {
+				return err
+			}
+		}
+
 		logrus.Debugf("Starting daemon")
-		_, k, err := StartDaemon("/usr/bin/docker", sr.config.DockerLogCapturer)
+		finished := func(error) {}
+		if sr.config.RunConfiguration.Upgrade != nil {
+			// The upgraded daemon migrates the graph before it
+			// accepts connections, the migration is not timed
+			// separately from the daemon start
+			finished = sr.startPhase(PhaseUpgradeStart)
+		}
+		client, k, err := startDaemon("/usr/bin/docker", sr.config.DockerLogCapturer, daemonConfig, sr.testDaemonRuntime())
+		finished(err)
 		if err != nil {
 			return fmt.Errorf("error starting daemon: %s", err)
 		}
-		sr.daemonCloser = k
+		sr.daemonClosers = append(sr.daemonClosers, k)
 
-		if sr.config.ComposeFile != "" {
-			logrus.Debugf("Build compose images")
-			buildScript := Script{
-				Command: []string{"docker-compose", "-f", sr.config.ComposeFile, "build", "--no-cache"},
+		for _, daemon := range sr.config.RunConfiguration.Daemons {
+			lc, ok := sr.config.NamedDaemonLogCapturers[daemon.Name]
+			if !ok {
+				return fmt.Errorf("missing log capturer for daemon %s", daemon.Name)
 			}
-			if err := RunScript(sr.config.ComposeCapturer, buildScript); err != nil {
-				return fmt.Errorf("error running docker compose build: %v", err)
+			logrus.Debugf("Starting daemon %s", daemon.Name)
+			_, k, err := StartNamedDaemon(daemon, lc)
+			if err != nil {
+				return fmt.Errorf("error starting daemon %s: %s", daemon.Name, err)
 			}
-			upScript := Script{
-				Command: []string{"docker-compose", "-f", sr.config.ComposeFile, "up", "-d"},
+			sr.daemonClosers = append(sr.daemonClosers, k)
+		}
+
+		if len(sr.config.ComposeFiles) > 0 {
+			if build := sr.composeConfiguration().Build; build != ComposeBuildNone {
+				logrus.Debugf("Build compose images")
+				buildArgs := []string{"build"}
+				if build != ComposeBuildCache {
+					buildArgs = append(buildArgs, "--no-cache")
+				}
+				if err := RunScript(sr.config.ComposeCapturer, sr.composeScript(buildArgs...)); err != nil {
+					return fmt.Errorf("error running docker compose build: %v", err)
+				}
 			}
 
-			if err := RunScript(sr.config.ComposeCapturer, upScript); err != nil {
+			upArgs := []string{"up", "-d"}
+			if sr.composeConfiguration().Build == ComposeBuildNone {
+				upArgs = append(upArgs, "--no-build")
+			}
+			if err := RunScript(sr.config.ComposeCapturer, sr.composeScript(upArgs...)); err != nil {
 				return fmt.Errorf("error running docker compose up: %v", err)
 			}
 
-			go func() {
-				logrus.Debugf("Listening for logs")
-				logScript := Script{
-					Command: []string{"docker-compose", "-f", sr.config.ComposeFile, "logs"},
+			if sr.config.ComposeLogDir != "" {
+				collector, err := newComposeLogCollector(client, sr.config.ComposeLogDir, sr.ReportLogFile)
+				if err != nil {
+					return err
 				}
-				if err := RunScript(sr.config.ComposeCapturer, logScript); err != nil {
-					logrus.Errorf("Error running docker compose logs: %v", err)
+				sr.composeLogs = collector
+				if err := collector.Start(); err != nil {
+					return fmt.Errorf("error capturing compose logs: %v", err)
 				}
-			}()
+			}
+
+			if err := sr.waitForServices(client); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// composeConfiguration returns the compose configuration
+// from the run configuration or the default configuration.
+func (sr *SuiteRunner) composeConfiguration() ComposeConfiguration {
+	if cc := sr.config.RunConfiguration.Compose; cc != nil {
+		return *cc
+	}
+	return ComposeConfiguration{}
+}
+
+// composeScript returns a script running compose with the
+// provided arguments using the suite's compose files. The
+// addresses of the named daemons are available to compose.
+func (sr *SuiteRunner) composeScript(args ...string) Script {
+	return Script{
+		Command: composeCommand(sr.composeConfiguration(), sr.config.ComposeFiles, args...),
+		Env:     NamedDaemonEnv(sr.config.RunConfiguration.Daemons),
+	}
+}
+
+// waitForServices waits for the compose services to pass their
+// readiness checks. The logs for any service which does not become
+// ready are written to the test capturer.
+func (sr *SuiteRunner) waitForServices(client *dockerclient.Client) error {
+	checks := sr.config.RunConfiguration.Ready
+	if len(checks) == 0 {
+		return nil
+	}
+
+	logrus.Debugf("Waiting for %d compose services to be ready", len(checks))
+	start := time.Now()
+	failed := waitForReady(checks, sr.config.RunConfiguration.ReadyTimeout)
+	if len(failed) == 0 {
+		logrus.Debugf("Compose services ready in %s", time.Since(start))
+		return nil
+	}
+
+	dumped := map[string]struct{}{}
+	for _, f := range failed {
+		logrus.Errorf("Service not ready after %s: %s: %v", time.Since(start), f.check, f.err)
+		if _, ok := dumped[f.check.Service]; ok {
+			continue
 		}
+		dumped[f.check.Service] = struct{}{}
+		if err := dumpServiceLogs(client, f.check.Service, sr.config.TestCapturer.Stderr()); err != nil {
+			logrus.Errorf("Error dumping logs for %s: %v", f.check.Service, err)
+		}
+	}
+
+	return fmt.Errorf("compose service %s never became ready", failed[0].check.Service)
+}
+
+// testDaemonRuntime returns the runtime for the test daemon. When
+// upgrading, the daemon is given more time to start since it may
+// need to migrate the graph created by the previous version.
+func (sr *SuiteRunner) testDaemonRuntime() daemonRuntime {
+	rt := defaultDaemonRuntime("daemon")
+	if sr.config.RunConfiguration.Upgrade != nil {
+		rt.startTimeout = upgradeStartTimeout
+	}
+	return rt
+}
+
+// runBeforeUpgrade starts the daemon being upgraded from and runs
+// the before tests. The daemon is stopped gracefully so the test
+// daemon may start on the same graph. Test failures are recorded
+// and reported along with the test results.
+func (sr *SuiteRunner) runBeforeUpgrade(upgrade *UpgradeConfiguration, dc DaemonConfiguration) error {
+	lc := sr.config.UpgradeLogCapturer
+	if lc == nil {
+		lc = sr.config.DockerLogCapturer
+	}
+
+	logrus.Infof("Starting daemon %s before upgrade", upgrade.Binary)
+	rt := defaultDaemonRuntime("daemon-" + upgradeDaemonName)
+	rt.graceful = true
+	_, k, err := startDaemon(upgrade.Binary, lc, dc, rt)
+	if err != nil {
+		return fmt.Errorf("error starting daemon before upgrade: %s", err)
+	}
+
+	start := time.Now()
+	sr.upgradeErr = sr.runTestScripts(upgrade.Before, UpgradeBefore)
+	if sr.upgradeErr != nil {
+		logrus.Errorf("Tests before upgrade failed after %s: %v", time.Since(start), sr.upgradeErr)
+	} else {
+		logrus.Infof("Tests before upgrade passed in %s", time.Since(start))
+	}
+
+	logrus.Debugf("Stopping daemon before upgrade")
+	if err := k(); err != nil {
+		return fmt.Errorf("error stopping daemon before upgrade: %v", err)
 	}
 
 	return nil
@@ -159,18 +399,33 @@ func (sr *SuiteRunner) Setup() error {
 // TearDown releases on test resources and stops any running containers
 // docker daemon.
 func (sr *SuiteRunner) TearDown() (err error) {
+	finished := sr.startPhase(PhaseTearDown)
+	defer func() { finished(err) }()
 	if sr.config.DockerInDocker {
-		if sr.config.ComposeFile != "" {
-			stopScript := Script{
-				Command: []string{"docker-compose", "-f", sr.config.ComposeFile, "stop"},
-			}
-			if err := RunScript(sr.config.ComposeCapturer, stopScript); err != nil {
+		if len(sr.config.ComposeFiles) > 0 {
+			if err := RunScript(sr.config.ComposeCapturer, sr.composeScript("stop")); err != nil {
 				logrus.Errorf("Error stopping docker compose: %v", err)
 			}
+			if sr.composeLogs != nil {
+				if err := sr.composeLogs.Close(); err != nil {
+					logrus.Errorf("Error closing compose logs: %v", err)
+				}
+				if err := sr.composeLogs.InspectContainers(); err != nil {
+					logrus.Errorf("Error inspecting compose containers: %v", err)
+				}
+			}
 		}
 
-		if err = sr.daemonCloser(); err != nil {
-			logrus.Errorf("Error stopping daemon: %v", err)
+		for i := len(sr.daemonClosers) - 1; i >= 0; i-- {
+			if err = sr.daemonClosers[i](); err != nil {
+				logrus.Errorf("Error stopping daemon: %v", err)
+			}
+		}
+
+		if sr.mirrorCloser != nil {
+			if err := sr.mirrorCloser(); err != nil {
+				logrus.Errorf("Error stopping registry mirror: %v", err)
+			}
 		}
 	}
 
@@ -180,14 +435,103 @@ func (sr *SuiteRunner) TearDown() (err error) {
 // RunTests runs the tests in order, capturing any output to
 // the test capturer.
 // TODO: Parse output and send to a test result manager.
-func (sr *SuiteRunner) RunTests() error {
-	for _, runner := range sr.config.RunConfiguration.TestRunner {
-		cmd := exec.Command(runner.Command[0], runner.Command[1:]...)
-		// TODO: Parse Stdout using sr.config.RunConfiguration.TestRunner.Format
-		cmd.Stdout = sr.config.TestCapturer.Stdout()
-		cmd.Stderr = sr.config.TestCapturer.Stderr()
-		cmd.Env = runner.Env
-		if err := cmd.Run(); err != nil {
+func (sr *SuiteRunner) RunTests() (err error) {
+	finished := sr.startPhase(PhaseTests)
+	defer func() { finished(err) }()
+
+	if upgrade := sr.config.RunConfiguration.Upgrade; upgrade != nil {
+		start := time.Now()
+		if err := sr.runTestScripts(upgrade.After, UpgradeAfter); err != nil {
+			logrus.Errorf("Tests after upgrade failed after %s: %v", time.Since(start), err)
+			return fmt.Errorf("upgrade error: %v", err)
+		}
+		logrus.Infof("Tests after upgrade passed in %s", time.Since(start))
+		if sr.upgradeErr != nil {
+			return fmt.Errorf("upgrade error: tests before upgrade failed: %v", sr.upgradeErr)
+		}
+	}
+
+	scripts := sr.config.RunConfiguration.TestRunner
+	if sr.config.Sharded {
+		if len(sr.config.ShardFiles) == 0 {
+			logrus.Infof("No test files in shard, skipping tests")
+			return nil
+		}
+		logrus.Infof("Running shard test files: %s", strings.Join(sr.config.ShardFiles, " "))
+		scripts = shardScripts(scripts, sr.config.ShardFiles)
+	}
+
+	return sr.runTestScripts(scripts, "")
+}
+
+const (
+	// OutcomePassed is the test outcome when all tests passed
+	OutcomePassed = "passed"
+
+	// OutcomeFailed is the test outcome when a test failed
+	OutcomeFailed = "failed"
+
+	// OutcomeSetupFailed is the test outcome when setup
+	// failed and no tests were run
+	OutcomeSetupFailed = "setup-failed"
+)
+
+// RunPostTest runs the on failure scripts when setup or the tests
+// failed, followed by the post test scripts. The outcome of the
+// tests is provided to each script as GOLEM_TEST_OUTCOME along with
+// the error as GOLEM_TEST_ERROR. An error is returned if any post
+// test script fails, on failure script errors are only logged.
+func (sr *SuiteRunner) RunPostTest(setupErr, testErr error) (postErr error) {
+	finished := sr.startPhase(PhasePostTest)
+	defer func() { finished(postErr) }()
+
+	outcome := OutcomePassed
+	var outcomeErr error
+	switch {
+	case setupErr != nil:
+		outcome, outcomeErr = OutcomeSetupFailed, setupErr
+	case testErr != nil:
+		outcome, outcomeErr = OutcomeFailed, testErr
+	}
+	env := []string{"GOLEM_TEST_OUTCOME=" + outcome}
+	if outcomeErr != nil {
+		env = append(env, "GOLEM_TEST_ERROR="+outcomeErr.Error())
+	}
+
+	if outcomeErr != nil {
+		for _, script := range sr.config.RunConfiguration.OnFailure {
+			if err := sr.runScript("onfailure", sr.config.OnFailureLogCapturer, sr.withEnv(script, env...)); err != nil {
+				logrus.Errorf("Error running on failure script %s: %v", script.Command[0], err)
+			}
+		}
+	}
+
+	for _, script := range sr.config.RunConfiguration.PostTest {
+		if err := sr.runScript("posttest", sr.config.PostTestLogCapturer, sr.withEnv(script, env...)); err != nil {
+			logrus.Errorf("Error running post test script %s: %v", script.Command[0], err)
+			if postErr == nil {
+				postErr = fmt.Errorf("error running post test script %s: %v", script.Command[0], err)
+			}
+		}
+	}
+
+	return postErr
+}
+
+// withEnv returns the script with the suite, instance, named daemon,
+// and script environment merged followed by any provided variables.
+func (sr *SuiteRunner) withEnv(script Script, env ...string) Script {
+	rc := sr.config.RunConfiguration
+	script.Env = mergeEnv(rc.SuiteEnv, rc.Env, NamedDaemonEnv(rc.Daemons), script.Env, env)
+	return script
+}
+
+// runTestScripts runs the test scripts in order, stopping at the
+// first script which fails after its retries. The results are
+// reported with the upgrade stage, empty for the test runners.
+func (sr *SuiteRunner) runTestScripts(scripts []TestScript, stage string) error {
+	for _, runner := range scripts {
+		if err := sr.runTestScript(runner, stage); err != nil {
 			return fmt.Errorf("run error: %s", err)
 		}
 	}
@@ -195,22 +539,236 @@ func (sr *SuiteRunner) RunTests() error {
 	return nil
 }
 
+// runTestScript runs a test script, rerunning only the failed tests up
+// to its number of retries while it fails. When the script is retried,
+// the latest result of each test is reported after the last attempt and
+// tests which failed in an earlier attempt are reported as flaky once
+// they pass.
+func (sr *SuiteRunner) runTestScript(runner TestScript, stage string) error {
+	var (
+		err     error
+		retries = runner.Retries
+		failed  = map[string]bool{}
+		names   []string
+		results = map[string]TestResult{}
+	)
+	if retries < 0 {
+		retries = 0
+	}
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			logrus.Infof("Retrying %d failed tests of %s (%d/%d)", len(failed), runner.Command[0], attempt, retries)
+		}
+
+		var attemptFailed []string
+		report := func(result TestResult) {
+			result.Upgrade = stage
+			sr.config.Events.Report(Event{Type: EventTestResult, Result: &result})
+		}
+		if retries > 0 {
+			report = func(result TestResult) {
+				if _, ok := results[result.Name]; !ok {
+					names = append(names, result.Name)
+				}
+				result.Upgrade = stage
+				results[result.Name] = result
+				if result.Status == TestFailed {
+					attemptFailed = append(attemptFailed, result.Name)
+				}
+			}
+		}
+
+		command := filterCommand(runner)
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdout = sr.config.TestCapturer.Stdout()
+		if runner.Format == "tap" {
+			cmd.Stdout = io.MultiWriter(cmd.Stdout, newTAPWriter(report))
+		}
+		cmd.Stderr = sr.config.TestCapturer.Stderr()
+		rc := sr.config.RunConfiguration
+		cmd.Env = inheritEnv(rc.SuiteEnv, rc.Env, NamedDaemonEnv(rc.Daemons), runner.Env)
+		start := time.Now()
+		err = cmd.Run()
+		sr.reportScript("test", command, start, err)
+
+		if err == nil || attempt == retries {
+			break
+		}
+		// Only the failed tests are retried, when the command
+		// failed without a failed test it is rerun as before
+		if len(attemptFailed) > 0 {
+			for _, name := range attemptFailed {
+				failed[name] = true
+			}
+			runner.Filter = testFilter(attemptFailed)
+		}
+	}
+	for _, name := range names {
+		result := results[name]
+		if result.Status == TestPassed && failed[name] {
+			result.Status = TestFlaky
+		}
+		sr.config.Events.Report(Event{Type: EventTestResult, Result: &result})
+	}
+	return err
+}
+
+// runScript runs the script with RunScript and reports
+// the exit code of the script.
+func (sr *SuiteRunner) runScript(kind string, lc LogCapturer, script Script) error {
+	start := time.Now()
+	err := RunScript(lc, script)
+	sr.reportScript(kind, script.Command, start, err)
+	return err
+}
+
+func (sr *SuiteRunner) reportScript(kind string, command []string, start time.Time, err error) {
+	event := Event{
+		Type:     EventScriptExited,
+		Duration: time.Since(start),
+		Script: &ScriptResult{
+			Kind:     kind,
+			Command:  command,
+			ExitCode: exitCode(err),
+		},
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	sr.config.Events.Report(event)
+}
+
+// ReportLogFile reports a log file written to the log directory
+func (sr *SuiteRunner) ReportLogFile(filename string) {
+	rel, err := filepath.Rel(sr.config.LogDir, filename)
+	if err != nil || sr.config.LogDir == "" {
+		rel = filename
+	}
+	sr.config.Events.Report(Event{Type: EventLogFile, LogFile: filepath.ToSlash(rel)})
+}
+
+// exitCode returns the exit code from the error returned
+// by running a command, -1 if the command did not exit.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return ws.ExitStatus()
+		}
+	}
+	return -1
+}
+
 // RunScript runs the script command attaching
-// results to stdout and stdout
+// results to stdout and stdout. The script environment
+// is merged with the environment of the current process.
 func RunScript(lc LogCapturer, script Script) error {
 	cmd := exec.Command(script.Command[0], script.Command[1:]...)
 	cmd.Stdout = lc.Stdout()
 	cmd.Stderr = lc.Stderr()
-	cmd.Env = script.Env
+	cmd.Env = inheritEnv(script.Env)
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("could not start script: %s", err)
 	}
 	return cmd.Wait()
 }
 
+// daemonRuntime is the runtime location and storage
+// for a daemon inside the test instance container.
+type daemonRuntime struct {
+	// configName is the name of the daemon configuration file,
+	// matching the name of the daemon log
+	configName string
+
+	// host is the address the daemon listens on, if empty
+	// the daemon listens on the default socket.
+	host string
+
+	graph         string
+	pidFile       string
+	execRoot      string
+	storageDriver string
+	args          []string
+
+	// startTimeout is how long to wait for the daemon to
+	// respond after starting, if zero a default is used.
+	startTimeout time.Duration
+
+	// graceful stops the daemon with a terminate signal
+	// rather than killing it.
+	graceful bool
+}
+
+const (
+	defaultStartTimeout = 10 * time.Second
+	upgradeStartTimeout = 10 * time.Minute
+	stopTimeout         = 30 * time.Second
+)
+
 // StartDaemon starts a daemon using the provided binary returning
-// a client to the binary, a close function, and error.
-func StartDaemon(binary string, lc LogCapturer) (*dockerclient.Client, func() error, error) {
+// a client to the binary, a close function, and error. The daemon
+// configuration provides extra arguments, environment variables,
+// and the daemon configuration file, which is written using the
+// given name.
+func StartDaemon(name, binary string, lc LogCapturer, dc DaemonConfiguration) (*dockerclient.Client, func() error, error) {
+	return startDaemon(binary, lc, dc, defaultDaemonRuntime(name))
+}
+
+// defaultDaemonRuntime returns the runtime for a daemon using
+// the default socket and graph directory.
+func defaultDaemonRuntime(name string) daemonRuntime {
+	return daemonRuntime{
+		configName:    name,
+		pidFile:       "/var/run/docker.pid",
+		storageDriver: getGraphDriver(),
+	}
+}
+
+// StartNamedDaemon starts a named daemon listening on its own socket
+// and using its own graph directory. The address of the daemon is
+// available to tests through the environment from NamedDaemonEnv.
+func StartNamedDaemon(daemon NamedDaemonConfiguration, lc LogCapturer) (*dockerclient.Client, func() error, error) {
+	storageDriver := daemon.StorageDriver
+	if storageDriver == "" {
+		storageDriver = getGraphDriver()
+	}
+	rt := daemonRuntime{
+		configName:    "daemon-" + daemon.Name,
+		host:          namedDaemonHost(daemon.Name),
+		graph:         daemonGraph(daemon.Name),
+		pidFile:       "/var/run/docker-" + daemon.Name + ".pid",
+		execRoot:      "/var/run/docker-" + daemon.Name,
+		storageDriver: storageDriver,
+		// Only the test daemon manages the default bridge
+		args: []string{"--bridge=none"},
+	}
+	return startDaemon(daemon.Binary, lc, daemon.DaemonConfiguration, rt)
+}
+
+// namedDaemonHost returns the address of the named daemon
+func namedDaemonHost(name string) string {
+	return "unix:///var/run/docker-" + name + ".sock"
+}
+
+// NamedDaemonEnv returns the environment variables which provide
+// the addresses of the named daemons, as DOCKER_HOST_<NAME>.
+func NamedDaemonEnv(daemons []NamedDaemonConfiguration) []string {
+	env := make([]string, 0, len(daemons))
+	for _, daemon := range daemons {
+		env = append(env, namedDaemonEnvName(daemon.Name)+"="+namedDaemonHost(daemon.Name))
+	}
+	return env
+}
+
+// namedDaemonEnvName returns the name of the environment
+// variable holding the address of the named daemon
+func namedDaemonEnvName(name string) string {
+	return "DOCKER_HOST_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func startDaemon(binary string, lc LogCapturer, dc DaemonConfiguration, rt daemonRuntime) (*dockerclient.Client, func() error, error) {
 	// Get Docker version of process
 	previousVersion, err := versionutil.BinaryVersion(binary)
 	if err != nil {
@@ -225,10 +783,38 @@ func StartDaemon(binary string, lc LogCapturer) (*dockerclient.Client, func() er
 		binaryArgs = append(binaryArgs, "daemon")
 	}
 	binaryArgs = append(binaryArgs, "--log-level=debug")
-	binaryArgs = append(binaryArgs, "--storage-driver="+getGraphDriver())
+	binaryArgs = append(binaryArgs, "--storage-driver="+rt.storageDriver)
+	if rt.host != "" {
+		binaryArgs = append(binaryArgs, "--host="+rt.host)
+	}
+	if rt.graph != "" {
+		binaryArgs = append(binaryArgs, "--graph="+rt.graph)
+	}
+	if rt.pidFile != "/var/run/docker.pid" {
+		binaryArgs = append(binaryArgs, "--pidfile="+rt.pidFile)
+	}
+	if rt.execRoot != "" && !previousVersion.LessThan(versionutil.StaticVersion(1, 9, 0)) {
+		binaryArgs = append(binaryArgs, "--exec-root="+rt.execRoot)
+	}
+	binaryArgs = append(binaryArgs, rt.args...)
+	if dc.ConfigFile != "" {
+		configFile := filepath.Join("/etc/golem", rt.configName+".json")
+		if err := os.MkdirAll(filepath.Dir(configFile), 0755); err != nil {
+			return nil, nil, fmt.Errorf("could not create config directory: %s", err)
+		}
+		if err := ioutil.WriteFile(configFile, []byte(dc.ConfigFile), 0644); err != nil {
+			return nil, nil, fmt.Errorf("could not write daemon config: %s", err)
+		}
+		binaryArgs = append(binaryArgs, "--config-file="+configFile)
+	}
+	binaryArgs = append(binaryArgs, dc.Args...)
+	logrus.Debugf("Daemon arguments: %v", binaryArgs)
 	cmd := exec.Command(binary, binaryArgs...)
 	cmd.Stdout = lc.Stdout()
 	cmd.Stderr = lc.Stderr()
+	if len(dc.Env) > 0 {
+		cmd.Env = append(os.Environ(), dc.Env...)
+	}
 	if err := cmd.Start(); err != nil {
 		return nil, nil, fmt.Errorf("could not start daemon: %s", err)
 	}
@@ -236,35 +822,76 @@ func StartDaemon(binary string, lc LogCapturer) (*dockerclient.Client, func() er
 	logrus.Debugf("Waiting for daemon to start")
 	time.Sleep(2 * time.Second)
 
-	client, err := dockerclient.NewClientFromEnv()
+	var client *dockerclient.Client
+	if rt.host != "" {
+		client, err = dockerclient.NewClient(rt.host)
+	} else {
+		client, err = dockerclient.NewClientFromEnv()
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not initialize client: %s", err)
 	}
 
+	startTimeout := rt.startTimeout
+	if startTimeout == 0 {
+		startTimeout = defaultStartTimeout
+	}
+
 	// Wait for it to start
-	for i := 0; ; i++ {
+	deadline := time.Now().Add(startTimeout)
+	for {
 		v, err := client.Version()
 		if err == nil {
 			logrus.Debugf("Established connection to daemon with version %s", v.Get("Version"))
 			break
 		}
-		if i >= 10 {
-			logrus.Fatalf("Failed to establish connection to daemon, check logs, quitting")
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			return nil, nil, fmt.Errorf("failed to establish connection to daemon after %s, check logs: %v", startTimeout, err)
 		}
 		time.Sleep(time.Second)
 	}
 
 	kill := func() error {
-		if err := cmd.Process.Kill(); err != nil {
-			return err
+		if rt.graceful {
+			if err := stopProcess(cmd, stopTimeout); err != nil {
+				return err
+			}
+		} else {
+			if err := cmd.Process.Kill(); err != nil {
+				return err
+			}
+			time.Sleep(500 * time.Millisecond)
 		}
-		time.Sleep(500 * time.Millisecond)
-		return os.RemoveAll("/var/run/docker.pid")
+		return os.RemoveAll(rt.pidFile)
 	}
 
 	return client, kill, nil
 }
 
+// stopProcess sends a terminate signal to the process and waits for it
+// to exit, killing the process if it does not exit within the timeout.
+func stopProcess(cmd *exec.Cmd, timeout time.Duration) error {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+		logrus.Errorf("Process %d did not exit after %s, killing", cmd.Process.Pid, timeout)
+		if err := cmd.Process.Kill(); err != nil {
+			return err
+		}
+		<-exited
+		return nil
+	}
+}
+
 type tagMap map[string][]string
 
 func listDiff(l1, l2 []string) ([]string, []string) {
@@ -365,25 +992,27 @@ func syncImages(client *dockerclient.Client, imageRoot string) error {
 
 	}
 
+	missing := []string{}
+	for imageID := range neededImages {
+		if _, err := client.InspectImage(imageID); err != nil {
+			logrus.Debugf("Missing image %s", imageID)
+			missing = append(missing, imageID)
+		}
+	}
+
+	var transferRefs []string
+	if len(missing) > 0 {
+		transferRefs, err = syncMissingImages(client, imageRoot, missing)
+		if err != nil {
+			return err
+		}
+	}
+
 	for imageID := range neededImages {
 		tags, ok := m[imageID]
 		if !ok {
 			return fmt.Errorf("missing image %s in tag map", imageID)
 		}
-		_, err := client.InspectImage(imageID)
-		if err != nil {
-			tf, err := os.Open(filepath.Join(imageRoot, imageID+".tar"))
-			if err != nil {
-				return fmt.Errorf("error opening image tar %s: %v", imageID, err)
-			}
-			defer tf.Close()
-			loadOptions := dockerclient.LoadImageOptions{
-				InputStream: tf,
-			}
-			if err := client.LoadImage(loadOptions); err != nil {
-				return fmt.Errorf("error loading image %s: %v", imageID, err)
-			}
-		}
 		for _, t := range tags {
 			if err := tagImage(client, imageID, t); err != nil {
 				return err
@@ -391,9 +1020,52 @@ func syncImages(client *dockerclient.Client, imageRoot string) error {
 		}
 	}
 
+	for _, ref := range transferRefs {
+		logrus.Debugf("Removing transfer tag %s", ref)
+		if err := client.RemoveImage(ref); err != nil {
+			return fmt.Errorf("error removing tag %s: %v", ref, err)
+		}
+	}
+
 	return nil
 }
 
+// syncMissingImages gets the missing images into the daemon. When
+// supported by the daemon, images are transferred by layer through
+// a local registry so only missing layers are copied. Otherwise the
+// full image archive is loaded.
+func syncMissingImages(client *dockerclient.Client, imageRoot string, missing []string) ([]string, error) {
+	v, err := client.Version()
+	if err != nil {
+		return nil, fmt.Errorf("error getting daemon version: %v", err)
+	}
+	daemonVersion, err := versionutil.ParseVersion(v.Get("Version"))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected daemon version %s: %v", v.Get("Version"), err)
+	}
+
+	if !daemonVersion.LessThan(versionutil.StaticVersion(1, 10, 0)) {
+		refs, err := transferImages(client, imageRoot, missing)
+		if err == nil {
+			return refs, nil
+		}
+		logrus.Debugf("Unable to transfer images by layer, loading archive: %v", err)
+		for _, ref := range refs {
+			if err := client.RemoveImage(ref); err != nil {
+				logrus.Errorf("Error removing tag %s: %v", ref, err)
+			}
+		}
+	}
+
+	// All images are exported in a single archive, load
+	// once to get all missing images
+	if err := loadImages(client, imageRoot, missing); err != nil {
+		return nil, fmt.Errorf("error loading images: %v", err)
+	}
+
+	return nil, nil
+}
+
 func filterRepoTags(tags []string) []string {
 	filtered := make([]string, 0, len(tags))
 	for _, tag := range tags {
@@ -437,78 +1109,236 @@ func removeIfExists(path string) error {
 	return os.Remove(path)
 }
 
-func cleanDockerGraph(graphDir string, v versionutil.Version) error {
+// cleanDockerGraph cleans the docker graph directory so it may be used
+// by the given docker version. Migration state is always removed for
+// versions which do not use the content addressable layout. When full
+// is set all containers, volumes, and network state are removed along
+// with any graph driver content which is not referenced by an image.
+func cleanDockerGraph(graphDir string, v versionutil.Version, full bool) error {
 	logrus.Debugf("Cleaning for version %s", v)
 	// Handle migration files
 	migratedVersion := versionutil.StaticVersion(1, 10, 0)
 	migratedVersion.Tag = "dev"
-	if v.LessThan(migratedVersion) {
+	if !v.LessThan(migratedVersion) {
+		if full {
+			return cleanLayerStore(graphDir)
+		}
+		return nil
+	}
 
-		if err := removeIfExists(filepath.Join(graphDir, ".migration-v1-images.json")); err != nil {
+	if err := removeIfExists(filepath.Join(graphDir, ".migration-v1-images.json")); err != nil {
+		return err
+	}
+	if err := removeIfExists(filepath.Join(graphDir, ".migration-v1-tags")); err != nil {
+		return err
+	}
+
+	root := filepath.Join(graphDir, "graph")
+	migrationPurger := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
 			return err
 		}
-		if err := removeIfExists(filepath.Join(graphDir, ".migration-v1-tags")); err != nil {
-			return err
+		if !info.IsDir() {
+			if strings.HasPrefix(filepath.Base(path), ".migrat") {
+				logrus.Debugf("Removing migration file %s", path)
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+			}
 		}
+		return nil
+	}
+	if err := filepath.Walk(root, migrationPurger); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
-		root := filepath.Join(graphDir, "graph")
-		migrationPurger := func(path string, info os.FileInfo, err error) error {
-			if err != nil {
+	drivers, err := getAllGraphDrivers(graphDir)
+	if err != nil {
+		return err
+	}
+
+	// Remove all containers
+	infos, err := ioutil.ReadDir(filepath.Join(graphDir, "containers"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, info := range infos {
+		container := info.Name()
+		for _, graphDriver := range drivers {
+			if err := removeLayerGraphContent(container, "mount-id", graphDriver, graphDir); err != nil && !os.IsNotExist(err) {
 				return err
 			}
-			if !info.IsDir() {
-				if strings.HasPrefix(filepath.Base(path), ".migrat") {
-					logrus.Debugf("Removing migration file %s", path)
-					if err := os.Remove(path); err != nil {
-						return err
-					}
-				}
+			if err := removeLayerGraphContent(container, "init-id", graphDriver, graphDir); err != nil && !os.IsNotExist(err) {
+				return err
 			}
-			return nil
 		}
-		if err := filepath.Walk(root, migrationPurger); err != nil {
+		if err := os.RemoveAll(filepath.Join(graphDir, "containers", container)); err != nil {
 			return err
 		}
+	}
+	if err := os.RemoveAll(filepath.Join(graphDir, "image")); err != nil {
+		return err
+	}
+	if err := removeIfExists(filepath.Join(graphDir, "linkgraph.db")); err != nil {
+		return err
+	}
 
-		// Remove all containers
-		infos, err := ioutil.ReadDir(filepath.Join(graphDir, "containers"))
+	if full {
+		// Remove everything in graph driver directory which is not in graph
+		images, err := readDirNames(root)
 		if err != nil {
-			if os.IsNotExist(err) {
-				return nil
+			return err
+		}
+		for _, graphDriver := range drivers {
+			if err := removeOrphanedDriverContent(graphDir, graphDriver, images); err != nil {
+				return err
 			}
+		}
+		if err := removeVolatileState(graphDir); err != nil {
 			return err
 		}
-		drivers, err := getAllGraphDrivers(graphDir)
+	}
+
+	return nil
+}
+
+// cleanLayerStore cleans a graph directory using the content addressable
+// layout by removing all containers and any graph driver content which
+// is not referenced by a layer in the layer store.
+func cleanLayerStore(graphDir string) error {
+	drivers, err := readDirNames(filepath.Join(graphDir, "image"))
+	if err != nil {
+		return err
+	}
+
+	containers, err := readDirNames(filepath.Join(graphDir, "containers"))
+	if err != nil {
+		return err
+	}
+	for container := range containers {
+		for graphDriver := range drivers {
+			if err := removeLayerGraphContent(container, "mount-id", graphDriver, graphDir); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := removeLayerGraphContent(container, "init-id", graphDriver, graphDir); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			mountRoot := filepath.Join(graphDir, "image", graphDriver, "layerdb", "mounts", container)
+			if err := os.RemoveAll(mountRoot); err != nil {
+				return err
+			}
+		}
+		logrus.Debugf("Removing container %s", container)
+		if err := os.RemoveAll(filepath.Join(graphDir, "containers", container)); err != nil {
+			return err
+		}
+	}
+
+	for graphDriver := range drivers {
+		layerRoot := filepath.Join(graphDir, "image", graphDriver, "layerdb", "sha256")
+		layers, err := readDirNames(layerRoot)
 		if err != nil {
 			return err
 		}
-		for _, info := range infos {
-			container := info.Name()
-			for _, graphDriver := range drivers {
-				if err := removeLayerGraphContent(container, "mount-id", graphDriver, graphDir); err != nil && !os.IsNotExist(err) {
-					return err
-				}
-				if err := removeLayerGraphContent(container, "init-id", graphDriver, graphDir); err != nil && !os.IsNotExist(err) {
-					return err
+		cacheIDs := map[string]struct{}{}
+		for layer := range layers {
+			cacheID, err := ioutil.ReadFile(filepath.Join(layerRoot, layer, "cache-id"))
+			if err != nil {
+				if os.IsNotExist(err) {
+					// Incomplete layer, will be ignored by daemon
+					logrus.Debugf("Removing incomplete layer %s", layer)
+					if err := os.RemoveAll(filepath.Join(layerRoot, layer)); err != nil {
+						return err
+					}
+					continue
 				}
-			}
-			if err := os.RemoveAll(filepath.Join(graphDir, "containers", container)); err != nil {
 				return err
 			}
+			cacheIDs[strings.TrimSpace(string(cacheID))] = struct{}{}
 		}
-		if err := os.RemoveAll(filepath.Join(graphDir, "image")); err != nil {
+		if err := removeOrphanedDriverContent(graphDir, graphDriver, cacheIDs); err != nil {
 			return err
 		}
-		if err := removeIfExists(filepath.Join(graphDir, "linkgraph.db")); err != nil {
+	}
+
+	return removeVolatileState(graphDir)
+}
+
+// driverContentDirs are the directories for each graph driver which
+// hold content named by the layer id. Drivers which are not listed
+// are not cleaned.
+var driverContentDirs = map[string][]string{
+	"aufs":     {"diff", "layers", "mnt"},
+	"btrfs":    {"subvolumes"},
+	"overlay":  {""},
+	"overlay2": {""},
+	"vfs":      {"dir"},
+}
+
+// removeOrphanedDriverContent removes all content in the graph driver
+// directory which does not belong to one of the provided layer ids.
+func removeOrphanedDriverContent(graphDir, graphDriver string, ids map[string]struct{}) error {
+	dirs, ok := driverContentDirs[graphDriver]
+	if !ok {
+		logrus.Debugf("Not cleaning graph driver %s", graphDriver)
+		return nil
+	}
+	for _, dir := range dirs {
+		contentDir := filepath.Join(graphDir, graphDriver, dir)
+		names, err := readDirNames(contentDir)
+		if err != nil {
 			return err
 		}
-
-		// TODO: Remove everything in graph driver directory which is not in graph
+		for name := range names {
+			if _, ok := ids[name]; ok {
+				continue
+			}
+			// Link directory used by overlay2 for short names
+			if graphDriver == "overlay2" && name == "l" {
+				continue
+			}
+			p := filepath.Join(contentDir, name)
+			logrus.Debugf("Removing orphaned graph content %s", p)
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
+// removeVolatileState removes state which depends on containers
+// and is not needed between runs.
+func removeVolatileState(graphDir string) error {
+	for _, dir := range []string{"volumes", "tmp", filepath.Join("network", "files")} {
+		p := filepath.Join(graphDir, dir)
+		if _, err := os.Stat(p); err == nil {
+			logrus.Debugf("Removing %s", p)
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// readDirNames returns the set of names in the directory, a
+// directory which does not exist is treated as empty.
+func readDirNames(dir string) (map[string]struct{}, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]struct{}{}, nil
+		}
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(infos))
+	for _, info := range infos {
+		names[info.Name()] = struct{}{}
+	}
+	return names, nil
+}
+
 func removeLayerGraphContent(layerID, filename, graphDriver, root string) error {
 	layerRoot := filepath.Join(root, "image", graphDriver, "layerdb", "mounts", layerID)
 	graphIDBytes, err := ioutil.ReadFile(filepath.Join(layerRoot, filename))
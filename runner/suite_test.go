@@ -0,0 +1,158 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/golem/versionutil"
+)
+
+func TestCleanDockerGraphLayerStore(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-graph-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	files := map[string]string{
+		"image/overlay/layerdb/sha256/aaaa/cache-id":       "layer1",
+		"image/overlay/layerdb/mounts/container1/mount-id": "mount1",
+		"image/overlay/layerdb/mounts/container1/init-id":  "mount1-init",
+		"image/overlay/repositories.json":                  "{}",
+		"containers/container1/config.json":                "{}",
+		"overlay/layer1/root/file":                         "",
+		"overlay/mount1/upper/file":                        "",
+		"overlay/mount1-init/upper/file":                   "",
+		"overlay/orphan/root/file":                         "",
+		"volumes/metadata.db":                              "",
+		"network/files/local-kv.db":                        "",
+	}
+	for name, content := range files {
+		p := filepath.Join(td, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := versionutil.StaticVersion(1, 10, 0)
+
+	// Without full cleaning nothing is removed
+	if err := cleanDockerGraph(td, v, false); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(td, name)); err != nil {
+			t.Fatalf("expected %s to exist: %v", name, err)
+		}
+	}
+
+	if err := cleanDockerGraph(td, v, true); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"image/overlay/layerdb/sha256/aaaa/cache-id",
+		"image/overlay/repositories.json",
+		"overlay/layer1/root/file",
+	}
+	removed := []string{
+		"image/overlay/layerdb/mounts/container1",
+		"containers/container1",
+		"overlay/mount1",
+		"overlay/mount1-init",
+		"overlay/orphan",
+		"volumes",
+		"network/files",
+	}
+	for _, name := range expected {
+		if _, err := os.Stat(filepath.Join(td, name)); err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+		}
+	}
+	for _, name := range removed {
+		if _, err := os.Stat(filepath.Join(td, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed: %v", name, err)
+		}
+	}
+}
+
+func TestTearDownPhaseReportedOnce(t *testing.T) {
+	counts := map[EventType]int{}
+	sr := NewSuiteRunner(SuiteRunnerConfiguration{
+		Events: EventHandlerFunc(func(event Event) {
+			if event.Phase == PhaseTearDown {
+				counts[event.Type]++
+			}
+		}),
+	})
+	if err := sr.TearDown(); err != nil {
+		t.Fatal(err)
+	}
+	for _, eventType := range []EventType{EventPhaseStarted, EventPhaseFinished} {
+		if counts[eventType] != 1 {
+			t.Errorf("Unexpected %s teardown events\n\tExpected: 1\n\tActual:   %d", eventType, counts[eventType])
+		}
+	}
+}
+
+func TestRetryFailedTests(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-retry-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// The test script fails "b" unless it is run filtered
+	script := `#!/bin/sh
+echo "$@" >> ` + filepath.Join(td, "args") + `
+if [ "$1" = "-f" ]; then
+	echo "ok 1 b"
+	exit 0
+fi
+echo "ok 1 a"
+echo "not ok 2 b"
+exit 1
+`
+	if err := ioutil.WriteFile(filepath.Join(td, "test.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []TestResult
+	sr := NewSuiteRunner(SuiteRunnerConfiguration{
+		TestCapturer: NewConsoleLogCapturer(),
+		Events: EventHandlerFunc(func(event Event) {
+			if event.Type == EventTestResult {
+				results = append(results, TestResult{Name: event.Result.Name, Status: event.Result.Status})
+			}
+		}),
+	})
+	runner := TestScript{
+		Script:    Script{Command: []string{filepath.Join(td, "test.sh")}},
+		Format:    "tap",
+		Retries:   2,
+		FilterArg: "-f",
+	}
+	if err := sr.runTestScript(runner, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TestResult{{Name: "a", Status: TestPassed}, {Name: "b", Status: TestFlaky}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("Unexpected results\n\tExpected: %v\n\tActual:   %v", expected, results)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(td, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first run has no arguments, the retry only runs "b"
+	if args := strings.Split(string(b), "\n"); len(args) != 3 || args[0] != "" || args[1] != "-f ^(b)$" {
+		t.Fatalf("Unexpected test command arguments: %q", args)
+	}
+}
@@ -0,0 +1,53 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// WriteSummary writes a summary of the instances in a run,
+// including the result and test counts of each instance
+// followed by the failed and flaky tests. Failed tests which
+// are known to be flaky are marked.
+func WriteSummary(w io.Writer, instances []InstanceStatus, flaky FlakyTests) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tRESULT\tPASSED\tFAILED\tFLAKY\tSKIPPED\tDURATION")
+	for _, instance := range instances {
+		counts := map[string]int{}
+		for _, result := range instance.Results {
+			counts[result.Status]++
+		}
+		var duration time.Duration
+		if !instance.Started.IsZero() {
+			duration = instance.Updated.Sub(instance.Started)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", instance.Name, instance.Phase, counts[TestPassed], counts[TestFailed], counts[TestFlaky], counts[TestSkipped], duration)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		for _, result := range instance.Results {
+			switch result.Status {
+			case TestFailed:
+				fmt.Fprintf(w, "FAIL %s: %s%s\n", instance.Name, result.Name, flakyMark(flaky, instance.Name, result.Name))
+			case TestFlaky:
+				fmt.Fprintf(w, "FLAKY %s: %s\n", instance.Name, result.Name)
+			}
+		}
+		if instance.Phase == PhaseFailed && instance.Error != "" {
+			fmt.Fprintf(w, "ERROR %s: %s\n", instance.Name, instance.Error)
+		}
+	}
+	return nil
+}
+
+func flakyMark(flaky FlakyTests, instance, test string) string {
+	if flaky.IsFlaky(instance, test) {
+		return " (known flaky)"
+	}
+	return ""
+}
@@ -0,0 +1,69 @@
+package runner
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var tapResultRegexp = regexp.MustCompile(`^(not ok|ok)\b\s*(\d+)?\s*(?:-\s*)?([^#]*)(?:#\s*(\w+).*)?$`)
+
+// tapWriter parses test results from TAP output
+// as it is written and reports each result. The
+// duration of a test is the time since the previous
+// result was written.
+type tapWriter struct {
+	buf    bytes.Buffer
+	report func(TestResult)
+	last   time.Time
+}
+
+func newTAPWriter(report func(TestResult)) *tapWriter {
+	return &tapWriter{
+		report: report,
+		last:   time.Now(),
+	}
+}
+
+func (tw *tapWriter) Write(p []byte) (int, error) {
+	tw.buf.Write(p)
+	for {
+		line, err := tw.buf.ReadString('\n')
+		if err != nil {
+			// Keep partial line until the rest is written
+			tw.buf.Reset()
+			tw.buf.WriteString(line)
+			break
+		}
+		if result, ok := parseTAPLine(strings.TrimRight(line, "\r\n")); ok {
+			now := time.Now()
+			result.Duration = now.Sub(tw.last)
+			tw.last = now
+			tw.report(result)
+		}
+	}
+	return len(p), nil
+}
+
+// parseTAPLine parses a TAP test line into a test result
+func parseTAPLine(line string) (TestResult, bool) {
+	m := tapResultRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return TestResult{}, false
+	}
+	result := TestResult{
+		Name:   strings.TrimSpace(m[3]),
+		Status: TestPassed,
+	}
+	if result.Name == "" {
+		result.Name = m[2]
+	}
+	switch {
+	case strings.EqualFold(m[4], "skip"):
+		result.Status = TestSkipped
+	case m[1] == "not ok" && !strings.EqualFold(m[4], "todo"):
+		result.Status = TestFailed
+	}
+	return result, true
+}
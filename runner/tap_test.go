@@ -0,0 +1,41 @@
+package runner
+
+import "testing"
+
+func TestTAPWriter(t *testing.T) {
+	var results []TestResult
+	tw := newTAPWriter(func(result TestResult) {
+		results = append(results, result)
+	})
+
+	output := "1..4\nok 1 push image\nnot ok 2 pull im"
+	if _, err := tw.Write([]byte(output)); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected partial line to be buffered, got %#v", results)
+	}
+	output = "age\n# (in test file pull.bats, line 10)\nok 3 login # skip no token server\nnot ok 4 - logout # TODO\n"
+	if _, err := tw.Write([]byte(output)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TestResult{
+		{Name: "push image", Status: TestPassed},
+		{Name: "pull image", Status: TestFailed},
+		{Name: "login", Status: TestSkipped},
+		{Name: "logout", Status: TestPassed},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("unexpected results %#v", results)
+	}
+	for i := range expected {
+		if results[i].Duration < 0 {
+			t.Errorf("result %d: negative duration %s", i, results[i].Duration)
+		}
+		results[i].Duration = 0
+		if results[i] != expected[i] {
+			t.Errorf("result %d: expected %#v, got %#v", i, expected[i], results[i])
+		}
+	}
+}
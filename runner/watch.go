@@ -0,0 +1,284 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/golem/versionutil"
+)
+
+// FileWatcher detects changes to files by polling
+// their modification time and size.
+type FileWatcher struct {
+	paths []string
+	files map[string]fileState
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewFileWatcher creates a watcher for the given files and
+// directories, directories are watched recursively.
+func NewFileWatcher(paths ...string) (*FileWatcher, error) {
+	w := &FileWatcher{
+		paths: paths,
+	}
+	files, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+	w.files = files
+	return w, nil
+}
+
+// scan returns the state of every watched file, hidden
+// files and editor backup files are ignored
+func (w *FileWatcher) scan() (map[string]fileState, error) {
+	files := map[string]fileState{}
+	for _, path := range w.paths {
+		err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			name := info.Name()
+			if p != path && (strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~")) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() {
+				files[p] = fileState{modTime: info.ModTime(), size: info.Size()}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error scanning %s: %v", path, err)
+		}
+	}
+	return files, nil
+}
+
+// Changes returns the files added, modified, or removed
+// since the previous call, sorted by path.
+func (w *FileWatcher) Changes() ([]string, error) {
+	files, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for p, state := range files {
+		if previous, ok := w.files[p]; !ok || previous != state {
+			changed = append(changed, p)
+		}
+	}
+	for p := range w.files {
+		if _, ok := files[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	w.files = files
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// Wait polls for changes at the given interval, returning once files
+// have changed and no further changes are seen for an interval.
+func (w *FileWatcher) Wait(interval time.Duration) ([]string, error) {
+	changed := map[string]struct{}{}
+	for {
+		time.Sleep(interval)
+		files, err := w.Changes()
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 && len(changed) > 0 {
+			break
+		}
+		for _, f := range files {
+			changed[f] = struct{}{}
+		}
+	}
+	files := make([]string, 0, len(changed))
+	for f := range changed {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// SuitePaths returns the directories of the configured suites
+func (c *ConfigurationManager) SuitePaths(loadDockerVersion versionutil.Version) ([]string, error) {
+	runConfig, err := c.runnerConfiguration(loadDockerVersion)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	seen := map[string]struct{}{}
+	for _, suite := range runConfig.Suites {
+		if _, ok := seen[suite.Path]; !ok {
+			seen[suite.Path] = struct{}{}
+			paths = append(paths, suite.Path)
+		}
+	}
+	return paths, nil
+}
+
+// CreateWatchRunner creates a test runner for the suites affected by
+// the changed files, every suite is run when no files are given. If no
+// suite is affected, a nil runner is returned.
+func (c *ConfigurationManager) CreateWatchRunner(loadDockerVersion versionutil.Version, cache CacheConfiguration, output OutputConfiguration, changed []string) (TestRunner, error) {
+	runConfig, err := c.runnerConfiguration(loadDockerVersion)
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) > 0 {
+		runConfig.Suites = watchSuites(runConfig.Suites, changed)
+		if len(runConfig.Suites) == 0 {
+			return nil, nil
+		}
+	}
+	return newRunner(runConfig, cache, output), nil
+}
+
+// watchSuites returns the suites affected by the changed files. When
+// only test files of a suite changed, only the bats test runners are
+// run with just the changed files. Any other change in a suite
+// directory runs the whole suite, changes outside of the suite
+// directories, such as to the docker binary, run every suite.
+func watchSuites(suites []SuiteConfiguration, changed []string) []SuiteConfiguration {
+	suiteChanges := map[string][]string{}
+	for _, file := range changed {
+		var inSuite bool
+		for _, suite := range suites {
+			rel, err := filepath.Rel(suite.Path, file)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			suiteChanges[suite.Path] = append(suiteChanges[suite.Path], rel)
+			inSuite = true
+		}
+		if !inSuite {
+			return suites
+		}
+	}
+
+	var watched []SuiteConfiguration
+	for _, suite := range suites {
+		files, ok := suiteChanges[suite.Path]
+		if !ok {
+			continue
+		}
+		var instances []InstanceConfiguration
+		for _, instance := range suite.Instances {
+			if testFiles, ok := watchTestFiles(suite.Path, instance, files); ok {
+				var runs bool
+				instance.RunConfiguration, runs = runTestFiles(instance.RunConfiguration, testFiles)
+				if !runs {
+					continue
+				}
+			}
+			instances = append(instances, instance)
+		}
+		if len(instances) > 0 {
+			suite.Instances = instances
+			watched = append(watched, suite)
+		}
+	}
+	return watched
+}
+
+// watchTestFiles returns the changed test files of the
+// instance, returning false if any other file changed
+// or a changed test file was removed.
+func watchTestFiles(suitePath string, instance InstanceConfiguration, files []string) ([]string, bool) {
+	pattern := defaultShardFiles
+	if instance.Shards != nil && instance.Shards.Files != "" {
+		pattern = instance.Shards.Files
+	}
+	var testFiles []string
+	for _, file := range files {
+		if match, err := filepath.Match(pattern, file); err != nil || !match {
+			return nil, false
+		}
+		if _, err := os.Stat(filepath.Join(suitePath, file)); err != nil {
+			return nil, false
+		}
+		testFiles = append(testFiles, file)
+	}
+	return testFiles, true
+}
+
+// runTestFiles returns the run configuration only running the
+// given test files with the bats test runners, in place of their
+// "." argument, returning false if the configuration has no bats
+// test runners. The instance is no longer sharded since only the
+// given files are run.
+func runTestFiles(rc RunConfiguration, files []string) (RunConfiguration, bool) {
+	batsScripts := func(scripts []TestScript) []TestScript {
+		var filtered []TestScript
+		for _, script := range scripts {
+			if len(script.Command) > 0 && filepath.Base(script.Command[0]) == "bats" {
+				if hasSuiteDirArg(script.Command) {
+					script.Command = shardCommand(script.Command, files)
+				}
+				filtered = append(filtered, script)
+			}
+		}
+		return filtered
+	}
+	rc.TestRunner = batsScripts(rc.TestRunner)
+	rc.Shards = nil
+	if rc.Upgrade != nil {
+		upgrade := *rc.Upgrade
+		upgrade.Before = batsScripts(upgrade.Before)
+		upgrade.After = batsScripts(upgrade.After)
+		rc.Upgrade = &upgrade
+		if len(upgrade.Before) > 0 || len(upgrade.After) > 0 {
+			return rc, true
+		}
+	}
+	return rc, len(rc.TestRunner) > 0
+}
+
+// WriteWatchSummary writes a compact summary of a run with
+// a line for each instance followed by its failed tests
+func WriteWatchSummary(w io.Writer, record RunRecord) error {
+	for _, instance := range record.Instances {
+		counts := map[string]int{}
+		for _, result := range instance.Results {
+			counts[result.Status]++
+		}
+		result := "PASS"
+		if instance.Phase != PhasePassed {
+			result = "FAIL"
+		}
+		var duration time.Duration
+		if !instance.Started.IsZero() {
+			duration = instance.Updated.Sub(instance.Started)
+		}
+		fmt.Fprintf(w, "%s %s: %d passed, %d failed (%s)\n", result, instance.Name, counts[TestPassed]+counts[TestFlaky], counts[TestFailed], duration)
+		for _, result := range instance.Results {
+			if result.Status == TestFailed {
+				fmt.Fprintf(w, "  %s\n", result.Name)
+			}
+		}
+		if instance.Phase != PhasePassed && instance.Error != "" {
+			fmt.Fprintf(w, "  %s\n", instance.Error)
+		}
+	}
+	if record.Error != "" {
+		fmt.Fprintf(w, "ERROR %s\n", record.Error)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileWatcher(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-watch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	for _, name := range []string{"a.bats", "b.bats", "golem.conf", ".a.bats.swp"} {
+		if err := ioutil.WriteFile(filepath.Join(td, name), []byte("1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := NewFileWatcher(td)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := w.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("Unexpected changes: %v", changes)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(td, "a.bats"), []byte("22"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(td, ".a.bats.swp"), []byte("22"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(td, "b.bats")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(td, "c.bats"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err = w.Wait(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(td, "a.bats"), filepath.Join(td, "b.bats"), filepath.Join(td, "c.bats")}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("Unexpected changes\n\tExpected: %v\n\tActual:   %v", expected, changes)
+	}
+}
+
+func TestWatchSuites(t *testing.T) {
+	td, err := ioutil.TempDir("", "golem-watch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	newSuite := func(name string) SuiteConfiguration {
+		if err := os.MkdirAll(filepath.Join(td, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range []string{"a.bats", "c.bats"} {
+			if err := ioutil.WriteFile(filepath.Join(td, name, file), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return SuiteConfiguration{
+			Name: name,
+			Path: filepath.Join(td, name),
+			Instances: []InstanceConfiguration{
+				{
+					Name: name,
+					RunConfiguration: RunConfiguration{
+						TestRunner: []TestScript{
+							{Command: []string{"bats", "-t", "."}},
+							{Command: []string{"go", "test", "./..."}},
+						},
+						Shards: &ShardConfiguration{Total: 2, Files: "*.bats"},
+					},
+				},
+			},
+		}
+	}
+	suites := []SuiteConfiguration{newSuite("one"), newSuite("two")}
+
+	// Changes outside of the suites run every suite
+	if watched := watchSuites(suites, []string{"/usr/local/bin/docker"}); !reflect.DeepEqual(watched, suites) {
+		t.Fatalf("Expected every suite to be run, got %#v", watched)
+	}
+
+	// Other changes in a suite run the whole suite
+	watched := watchSuites(suites, []string{filepath.Join(td, "two/golem.conf"), filepath.Join(td, "two/a.bats")})
+	if !reflect.DeepEqual(watched, suites[1:]) {
+		t.Fatalf("Expected suite two to be run, got %#v", watched)
+	}
+
+	// Changed test files only run those files
+	watched = watchSuites(suites, []string{filepath.Join(td, "one/a.bats"), filepath.Join(td, "one/c.bats")})
+	if len(watched) != 1 || watched[0].Name != "one" {
+		t.Fatalf("Expected suite one to be run, got %#v", watched)
+	}
+	rc := watched[0].Instances[0].RunConfiguration
+	expected := []TestScript{{Command: []string{"bats", "-t", "a.bats", "c.bats"}}}
+	if !reflect.DeepEqual(rc.TestRunner, expected) {
+		t.Fatalf("Unexpected test runner\n\tExpected: %#v\n\tActual:   %#v", expected, rc.TestRunner)
+	}
+	if rc.Shards != nil {
+		t.Fatalf("Expected instance to not be sharded")
+	}
+	if suites[0].Instances[0].TestRunner[0].Command[2] != "." {
+		t.Fatalf("Original configuration modified")
+	}
+
+	// A removed test file runs the whole suite
+	if err := os.Remove(filepath.Join(td, "one/a.bats")); err != nil {
+		t.Fatal(err)
+	}
+	watched = watchSuites(suites, []string{filepath.Join(td, "one/a.bats")})
+	if !reflect.DeepEqual(watched, suites[:1]) {
+		t.Fatalf("Expected suite one to be run, got %#v", watched)
+	}
+}
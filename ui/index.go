@@ -0,0 +1,123 @@
+package ui
+
+// indexHTML is the dashboard page. Instance status is loaded from
+// the instances api and updated from the status event stream, logs
+// are streamed from the tail endpoint.
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>golem</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; vertical-align: top; }
+.phase { font-weight: bold; }
+.passed, .pass { color: #2a7d2a; }
+.failed, .fail { color: #b52a2a; }
+.skip { color: #888; }
+.flaky { color: #b5822a; }
+.results { max-height: 12em; overflow-y: auto; font-size: 90%; }
+.logs a { margin-right: 0.8em; }
+#log { background: #111; color: #ddd; padding: 8px; height: 30em; overflow-y: scroll; white-space: pre-wrap; font-size: 85%; }
+</style>
+</head>
+<body>
+<h1>golem</h1>
+<table>
+<thead><tr><th>Instance</th><th>Suite</th><th>Phase</th><th>Tests</th><th>Results</th><th>Logs</th></tr></thead>
+<tbody id="instances"></tbody>
+</table>
+<h2 id="log-title">Logs</h2>
+<pre id="log"></pre>
+<script>
+var instances = {};
+var tail = null;
+
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text) { e.textContent = text; }
+  if (cls) { e.className = cls; }
+  return e;
+}
+
+function summary(results) {
+  var counts = {pass: 0, fail: 0, skip: 0, flaky: 0};
+  results.forEach(function(r) { counts[r.status]++; });
+  return counts.pass + " passed, " + counts.fail + " failed, " + counts.flaky + " flaky, " + counts.skip + " skipped";
+}
+
+function render() {
+  var body = document.getElementById("instances");
+  body.innerHTML = "";
+  Object.keys(instances).sort().forEach(function(name) {
+    var inst = instances[name];
+    var tr = el("tr");
+    tr.appendChild(el("td", inst.name));
+    tr.appendChild(el("td", inst.suite));
+    var phase = el("td", inst.phase, "phase " + inst.phase);
+    if (inst.error) { phase.appendChild(el("div", inst.error, "failed")); }
+    tr.appendChild(phase);
+    tr.appendChild(el("td", summary(inst.results || [])));
+    var results = el("td");
+    var list = el("div", "", "results");
+    (inst.results || []).forEach(function(r) {
+      list.appendChild(el("div", r.status + " " + r.name, r.status));
+    });
+    results.appendChild(list);
+    tr.appendChild(results);
+    var logs = el("td", "", "logs");
+    (inst.logfiles || []).forEach(function(f) {
+      var a = el("a", f);
+      a.href = "/logs/" + name + "/" + f;
+      a.target = "_blank";
+      var follow = el("a", "(follow)");
+      follow.href = "#";
+      follow.onclick = function() { follow_log(name, f); return false; };
+      logs.appendChild(a);
+      logs.appendChild(follow);
+      logs.appendChild(el("br"));
+    });
+    tr.appendChild(logs);
+    body.appendChild(tr);
+  });
+}
+
+function load() {
+  fetch("/api/instances").then(function(r) { return r.json(); }).then(function(list) {
+    list.forEach(function(inst) { instances[inst.name] = inst; });
+    render();
+  });
+}
+
+function follow_log(name, file) {
+  if (tail) { tail.close(); }
+  var log = document.getElementById("log");
+  log.textContent = "";
+  document.getElementById("log-title").textContent = "Logs: " + name + "/" + file;
+  tail = new EventSource("/tail/" + name + "/" + file);
+  tail.onmessage = function(e) {
+    var follow = log.scrollTop + log.clientHeight >= log.scrollHeight - 10;
+    log.textContent += JSON.parse(e.data);
+    if (follow) { log.scrollTop = log.scrollHeight; }
+  };
+}
+
+var events = new EventSource("/api/events");
+events.onmessage = function(e) {
+  var ev = JSON.parse(e.data);
+  var inst = instances[ev.instance];
+  if (!inst || ev.type != "test-result") {
+    // Reload to pick up new instances, phases, and log files
+    load();
+    return;
+  }
+  inst.results = (inst.results || []).concat([ev.result]);
+  render();
+};
+
+load();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,227 @@
+// Package ui provides a web dashboard for monitoring golem test
+// instances and browsing their logs while a run is in progress.
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/golem/runner"
+)
+
+// tailInterval is how often followed log files are checked for new content
+const tailInterval = 500 * time.Millisecond
+
+// Server serves the dashboard for the instances tracked by a monitor
+type Server struct {
+	monitor *runner.Monitor
+	mux     *http.ServeMux
+}
+
+// NewServer creates a dashboard server for the monitor
+func NewServer(monitor *runner.Monitor) *Server {
+	s := &Server{
+		monitor: monitor,
+		mux:     http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/", s.index)
+	s.mux.HandleFunc("/api/instances", s.instances)
+	s.mux.HandleFunc("/api/events", s.events)
+	s.mux.HandleFunc("/logs/", s.logs)
+	s.mux.HandleFunc("/tail/", s.tail)
+	return s
+}
+
+// ListenAndServe listens on the address and serves the dashboard
+// in the background, returning the address being listened on.
+// An address without a host listens on localhost only since the
+// dashboard is not authenticated.
+func (s *Server) ListenAndServe(addr string) (string, error) {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("error listening on %s: %v", addr, err)
+	}
+	go func() {
+		if err := http.Serve(l, s); err != nil {
+			logrus.Errorf("Error serving dashboard: %v", err)
+		}
+	}()
+	return l.Addr().String(), nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, indexHTML)
+}
+
+func (s *Server) instances(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.monitor.Instances()); err != nil {
+		logrus.Errorf("Error encoding instances: %v", err)
+	}
+}
+
+// events streams status events as server sent events
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := s.monitor.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	closed := w.(http.CloseNotifier).CloseNotify()
+	for {
+		select {
+		case event := <-events:
+			b, err := json.Marshal(event)
+			if err != nil {
+				logrus.Errorf("Error encoding event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			flusher.Flush()
+		case <-closed:
+			return
+		}
+	}
+}
+
+// logs serves a collected log file of an instance
+func (s *Server) logs(w http.ResponseWriter, r *http.Request) {
+	filename, ok := s.logFile(strings.TrimPrefix(r.URL.Path, "/logs/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, runner.Redact(string(b)))
+}
+
+// tail streams a log file of an instance as server sent
+// events, following the file as it is written.
+func (s *Server) tail(w http.ResponseWriter, r *http.Request) {
+	filename, ok := s.logFile(strings.TrimPrefix(r.URL.Path, "/tail/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	send := func(s string) {
+		if s == "" {
+			return
+		}
+		b, _ := json.Marshal(s)
+		fmt.Fprintf(w, "data: %s\n\n", b)
+		flusher.Flush()
+	}
+
+	// The end of each chunk is held back until the next chunk
+	// so a secret split across chunks is still redacted, it is
+	// sent once the file has not grown for an interval.
+	var (
+		pending string
+		idle    bool
+	)
+	closed := w.(http.CloseNotifier).CloseNotify()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			var out string
+			out, pending = runner.RedactStream(pending+string(buf[:n]), false)
+			send(out)
+			idle = false
+			continue
+		}
+		if err != nil && err != io.EOF {
+			logrus.Errorf("Error reading %s: %v", filename, err)
+			return
+		}
+		if idle && pending != "" {
+			out, _ := runner.RedactStream(pending, true)
+			send(out)
+			pending = ""
+		}
+		idle = true
+		select {
+		case <-closed:
+			return
+		case <-time.After(tailInterval):
+		}
+	}
+}
+
+// logFile resolves a path of the form <instance>/<file> to an
+// existing log file within the instance log directory.
+func (s *Server) logFile(p string) (string, bool) {
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", false
+	}
+	status, ok := s.monitor.Instance(parts[0])
+	if !ok || status.LogDir == "" {
+		return "", false
+	}
+	rel := filepath.Clean(filepath.FromSlash(parts[1]))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	// The log directory is written by the instance container,
+	// symlinks must not lead outside of it
+	dir, err := filepath.EvalSymlinks(status.LogDir)
+	if err != nil {
+		return "", false
+	}
+	filename, err := filepath.EvalSymlinks(filepath.Join(dir, rel))
+	if err != nil || !strings.HasPrefix(filename, dir+string(filepath.Separator)) {
+		return "", false
+	}
+	return filename, true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/golem/runner"
+	"github.com/docker/golem/versionutil"
+)
+
+// watch runs the tests and then reruns the tests affected by each
+// change to the suite directories or docker binary until interrupted.
+func watch(client runner.DockerClient, cm *runner.ConfigurationManager, loadDockerVersion versionutil.Version, c runner.CacheConfiguration, output runner.OutputConfiguration, dockerBinary string, interval time.Duration) {
+	var changed []string
+	for {
+		// Files are watched from before the run so changes
+		// made while the tests run trigger the next run
+		paths, err := cm.SuitePaths(loadDockerVersion)
+		if err != nil {
+			logrus.Fatalf("Error resolving suites: %v", err)
+		}
+		if dockerBinary != "" {
+			paths = append(paths, dockerBinary)
+		}
+		watcher, err := runner.NewFileWatcher(paths...)
+		if err != nil {
+			logrus.Fatalf("Error watching files: %v", err)
+		}
+
+		r, err := cm.CreateWatchRunner(loadDockerVersion, c, output, changed)
+		if err != nil {
+			logrus.Errorf("Error creating runner: %v", err)
+		} else if r == nil {
+			logrus.Infof("No tests affected by changes")
+		} else {
+			runOnce(client, r, output.History)
+		}
+
+		logrus.Infof("Watching for changes")
+		changed, err = watcher.Wait(interval)
+		if err != nil {
+			logrus.Fatalf("Error watching files: %v", err)
+		}
+		for _, file := range changed {
+			logrus.Debugf("Changed: %s", file)
+			if file == dockerBinary {
+				if err := putBinary(c, dockerBinary); err != nil {
+					logrus.Errorf("Error updating docker binary: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// runOnce builds and runs the tests, writing a compact
+// summary of the run recorded in the history
+func runOnce(client runner.DockerClient, r runner.TestRunner, history *runner.History) {
+	manifest, err := r.Build(client)
+	if err != nil {
+		logrus.Errorf("Error building test images: %v", err)
+	} else if err := r.Run(client, manifest); err != nil {
+		logrus.Errorf("Error running tests: %v", err)
+	}
+
+	record, err := history.Get(runner.LatestRun)
+	if err != nil {
+		logrus.Errorf("Error getting run: %v", err)
+		return
+	}
+	if err := runner.WriteWatchSummary(os.Stdout, record); err != nil {
+		logrus.Errorf("Error writing summary: %v", err)
+	}
+}
+
+// putBinary puts the docker binary in the build cache
+// and sets it as the docker version to test
+func putBinary(c runner.CacheConfiguration, dockerBinary string) error {
+	v, err := versionutil.BinaryVersion(dockerBinary)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Using local binary with version %s", v.String())
+	if err := c.BuildCache.PutVersion(v, dockerBinary); err != nil {
+		return err
+	}
+	return flag.Set("docker-version", v.String())
+}